@@ -0,0 +1,40 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// cleanupBackupsCmd removes the backups of the completed migrations
+var cleanupBackupsCmd = &cobra.Command{
+	Use:   "cleanup-backups",
+	Short: "Remove the manifest backups of the completed PVC migrations",
+	Long: `Remove the backup ConfigMaps, and the directories of --backup-dir if it is
+set, of the PVC migrations which completed, once the migrated applications
+were validated. The backups of the migrations which didn't complete are kept.
+Use --pvc and --pvc-ns to clean up a single PVC.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.CleanupBackups(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupBackupsCmd)
+}
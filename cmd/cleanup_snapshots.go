@@ -0,0 +1,41 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// cleanupSnapshotsCmd removes the snapshots taken of the rbd images before their migration
+var cleanupSnapshotsCmd = &cobra.Command{
+	Use:   "cleanup-snapshots",
+	Short: "Remove the snapshots taken before the PVC migrations",
+	Long: `Remove the pvm-pre-migration-<timestamp> snapshots taken of the rbd images
+before their migration, once the migrated applications were validated. The
+snapshots of the PVCs of the destination storageclass, and of the source
+storageclass for the rolled back migrations, are removed. Use --pvc and
+--pvc-ns to clean up a single PVC.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.CleanupSnapshots(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupSnapshotsCmd)
+}
@@ -16,12 +16,27 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"persistent-volume-migrator/pkg/ceph"
+	"persistent-volume-migrator/pkg/ceph/rbd"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+	"persistent-volume-migrator/pkg/metrics"
 	"persistent-volume-migrator/pkg/migration"
+	"persistent-volume-migrator/pkg/report"
 
 	"github.com/spf13/cobra"
 )
 
 var (
+	// runContext is done when the run is interrupted.
+	runContext              = context.Background()
 	kubeConfig              string
 	sourceStorageClass      string
 	destinationStorageClass string
@@ -29,6 +44,34 @@ var (
 	cephClusterNamespace    string
 	pvcName                 string
 	pvcNamespace            string
+	dryRun                  bool
+	autoDestination         bool
+	static                  bool
+	crossPool               bool
+	sourceClusterID         string
+	sourceCephClusterNS     string
+	csiConfigMap            string
+	csiConfigKey            string
+	provisionerSecret       string
+	provisionerSecretNS     string
+	cephCredentials         string
+	cephCredentialsSecret   string
+	rbdBackend              string
+	trashDelay              time.Duration
+	backupDir               string
+	preserveMetadata        []string
+	dropAnnotations         []string
+	force                   bool
+	scaleWorkloads          bool
+	parallelism             int
+	continueOnError         bool
+	namespaces              []string
+	namespaceSelector       string
+	pvcSelector             string
+	excludes                []string
+	reportFile              string
+	reportFormat            string
+	metricsAddr             string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -43,22 +86,95 @@ var rootCmd = &cobra.Command{
 	// 4. Delete the PVC object
 	// 5. Create new PVC with same name in destination storageclass
 	// 6. Extract new volume name from CSI PV
-	// 7. Delete the CSI volume in ceph cluster
+	// 7. Move the CSI volume to the trash in ceph cluster
 	// 8. Rename old ceph volume to new CSI volume
 	// 9. Delete old PV object
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// the controller handles the signals itself, completing the running
+		// migration on SIGTERM.
+		if cmd != controllerCmd {
+			runContext = interruptContext()
+		}
+		if metricsAddr == "" {
+			return nil
+		}
+		return metrics.Serve(metricsAddr)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if err := migration.MigrateToCSI(kubeConfig, sourceStorageClass,
-			destinationStorageClass, rookNamespace, cephClusterNamespace, pvcName, pvcNamespace); err != nil {
+		if err := migration.MigrateToCSI(migrationOptions()); err != nil {
 			return err
 		}
 		return nil
 	},
 }
 
+// interruptContext returns a context done on SIGINT or SIGTERM, so that the
+// run stops and cleans up, restoring the workloads and removing the ceph
+// keys. A second signal kills the process.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// migrationOptions returns the migration options set by the command line flags.
+func migrationOptions() *migration.Options {
+	return &migration.Options{
+		KubeConfig:                 kubeConfig,
+		SourceStorageClass:         sourceStorageClass,
+		DestinationStorageClass:    destinationStorageClass,
+		RookNamespace:              rookNamespace,
+		CephClusterNamespace:       cephClusterNamespace,
+		PVCName:                    pvcName,
+		PVCNamespace:               pvcNamespace,
+		DryRun:                     dryRun,
+		AutoDestination:            autoDestination,
+		Static:                     static,
+		CrossPool:                  crossPool,
+		SourceClusterID:            sourceClusterID,
+		SourceCephClusterNamespace: sourceCephClusterNS,
+		CSIConfigMap:               csiConfigMap,
+		CSIConfigKey:               csiConfigKey,
+		ProvisionerSecret:          provisionerSecret,
+		ProvisionerSecretNamespace: provisionerSecretNS,
+		Credentials:                cephCredentials,
+		CredentialsSecretName:      cephCredentialsSecret,
+		RBDBackend:                 rbdBackend,
+		TrashDelay:                 trashDelay,
+		BackupDir:                  backupDir,
+		Force:                      force,
+		ScaleWorkloads:             scaleWorkloads,
+		Parallelism:                parallelism,
+		ContinueOnError:            continueOnError,
+		ReportFile:                 reportFile,
+		ReportFormat:               reportFormat,
+		Filter: k8sutil.PVCFilter{
+			Namespaces:        namespaces,
+			NamespaceSelector: namespaceSelector,
+			PVCSelector:       pvcSelector,
+			Exclude:           excludes,
+		},
+		MetadataPolicy: k8sutil.MetadataPolicy{
+			Preserve:        preserveMetadata,
+			DropAnnotations: dropAnnotations,
+		},
+		Context: runContext,
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	err := rootCmd.Execute()
+	// the connections remove their keys when they are closed, this removes
+	// the ones left by a connection which wasn't.
+	if keyErr := ceph.RemoveKeys(); keyErr != nil {
+		logger.ErrorLog("failed to remove the ceph keys: %v", keyErr)
+	}
+	cobra.CheckErr(err)
 }
 
 func init() {
@@ -70,8 +186,36 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&kubeConfig, "kubeconfig", "", "kubernetes config path")
 	rootCmd.PersistentFlags().StringVar(&sourceStorageClass, "source-sc", "", "source storageclass from which all PVC need to be migrated")
 	rootCmd.PersistentFlags().StringVar(&destinationStorageClass, "destination-sc", "", "destination storageclass (CSI storageclass) to which all PVC need to be migrated")
+	rootCmd.PersistentFlags().BoolVar(&autoDestination, "auto-destination", false, "use the CSI storageclass with the pool and clusterID of the volumes to migrate as destination storageclass")
 	rootCmd.PersistentFlags().StringVar(&rookNamespace, "rook-ns", "rook-ceph", "Kubernetes namespace where rook operator is running")
 	rootCmd.PersistentFlags().StringVar(&cephClusterNamespace, "ceph-cluster-ns", "rook-ceph", "Kubernetes namespace where ceph cluster is created")
 	rootCmd.PersistentFlags().StringVar(&pvcName, "pvc", "", "Name of the specific pvc you want to migrate")
 	rootCmd.PersistentFlags().StringVar(&pvcNamespace, "pvc-ns", "", "Namespace of the specific pvc you want to migrate")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the operations of the migration without running them")
+	rootCmd.PersistentFlags().StringVar(&csiConfigMap, "csi-config-map", k8sutil.DefaultCSIConfigMap, "ConfigMap of the rook namespace holding the CSI configuration, like ceph-csi-config without Rook")
+	rootCmd.PersistentFlags().StringVar(&csiConfigKey, "csi-config-key", k8sutil.DefaultCSIConfigKey, "key of the CSI configuration in the ConfigMap, like config.json without Rook")
+	rootCmd.PersistentFlags().StringVar(&provisionerSecret, "provisioner-secret", "", "secret of the CSI provisioner, defaults to the one of the destination storageclass or to the one created by Rook")
+	rootCmd.PersistentFlags().StringVar(&provisionerSecretNS, "provisioner-secret-ns", "", "namespace of the secret of the CSI provisioner, defaults to the one of the destination storageclass or to --ceph-cluster-ns")
+	rootCmd.PersistentFlags().StringVar(&cephCredentials, "ceph-credentials", migration.CredentialsProvisioner, fmt.Sprintf("credentials all the ceph commands are run with, one of %v", migration.CredentialsSources()))
+	rootCmd.PersistentFlags().StringVar(&cephCredentialsSecret, "ceph-credentials-secret", "", "secret of --ceph-cluster-ns holding the userID and userKey of the ceph user, with --ceph-credentials=secret")
+	rootCmd.PersistentFlags().StringVar(&rbdBackend, "rbd-backend", rbd.ExecBackend, fmt.Sprintf("backend used to manage the rbd images, one of %v", rbd.Backends()))
+	rootCmd.PersistentFlags().DurationVar(&trashDelay, "trash-delay", 7*24*time.Hour, "period during which the placeholder CSI images moved to the rbd trash can't be purged")
+	rootCmd.PersistentFlags().StringVar(&backupDir, "backup-dir", "", "directory the manifests of the PVs and PVCs are saved to before they are changed, in addition to the backup ConfigMaps")
+	rootCmd.PersistentFlags().StringSliceVar(&preserveMetadata, "preserve-metadata", k8sutil.PreserveOptions(), fmt.Sprintf("metadata of the PVCs carried over to the CSI PVCs, among %v", k8sutil.PreserveOptions()))
+	rootCmd.PersistentFlags().StringArrayVar(&dropAnnotations, "drop-annotation", nil, "prefix of the PVC annotations not carried over to the CSI PVCs, can be repeated")
+	rootCmd.PersistentFlags().BoolVar(&force, "force", false, "migrate the PVCs even if their volume is still in use by pods, nodes or rbd clients")
+	rootCmd.PersistentFlags().BoolVar(&scaleWorkloads, "scale-workloads", false, "scale down the workloads using the PVCs during the migration and restore them afterwards")
+	rootCmd.PersistentFlags().IntVar(&parallelism, "parallelism", 1, "number of PVCs migrated concurrently")
+	rootCmd.PersistentFlags().BoolVar(&continueOnError, "continue-on-error", false, "carry on migrating the other PVCs when the migration of a PVC fails")
+	rootCmd.PersistentFlags().StringArrayVar(&namespaces, "namespace", nil, "only migrate the PVCs of this namespace, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&namespaceSelector, "namespace-selector", "", "only migrate the PVCs of the namespaces matching this label selector")
+	rootCmd.PersistentFlags().StringVar(&pvcSelector, "pvc-selector", "", "only migrate the PVCs matching this label selector")
+	rootCmd.PersistentFlags().StringArrayVar(&excludes, "exclude", nil, "namespace/name pattern of the PVCs to leave out, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&reportFile, "report-file", "", "file the report of the migration is written to")
+	rootCmd.PersistentFlags().StringVar(&reportFormat, "report-format", report.FormatJSON, fmt.Sprintf("format of the report, one of %v", report.Formats()))
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "address the Prometheus metrics are served on at /metrics, like :9090, no metrics are served if empty")
+	rootCmd.PersistentFlags().BoolVar(&crossPool, "cross-pool", false, "move the rbd images which aren't in the pool of the destination storageclass with an rbd live migration")
+	rootCmd.PersistentFlags().StringVar(&sourceClusterID, "source-cluster-id", "", "clusterID of the cluster of the old rbd images, if it isn't the cluster of the destination storageclass")
+	rootCmd.PersistentFlags().StringVar(&sourceCephClusterNS, "source-ceph-cluster-ns", "", "Kubernetes namespace of the CSI provisioner secret of the source cluster, defaults to --ceph-cluster-ns")
+	rootCmd.PersistentFlags().BoolVar(&static, "static", false, "bind the PVC to a static CSI PV pointing to the existing rbd image instead of renaming it")
 }
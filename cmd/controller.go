@@ -0,0 +1,52 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"persistent-volume-migrator/pkg/controller"
+
+	"github.com/spf13/cobra"
+)
+
+// controllerCmd runs the migrations declared by PersistentVolumeMigration resources
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Run the migrations declared by PersistentVolumeMigration resources",
+	Long: `Watch the PersistentVolumeMigration resources and migrate the PVCs they
+select to their destination storageclass, recording the progress of every PVC
+in their status. The flags set the options the resources leave unset. The
+migrations are run one at a time; on SIGTERM, the running migration is
+completed before the controller stops.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := controller.New(migrationOptions())
+		if err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return c.Run(ctx)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(controllerCmd)
+}
@@ -0,0 +1,45 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+var inventoryFormat string
+
+// inventoryCmd lists the ceph volumes which aren't provisioned by a CSI driver
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "List the ceph volumes which aren't provisioned by a CSI driver",
+	Long: `List every PV of the cluster provisioned by the Rook flex driver or by the
+in-tree rbd and cephfs drivers, with its PVC, storageclass, size, access modes,
+volume mode, the pods using it and its rbd image or CephFS share. Nothing is
+changed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.Inventory(migrationOptions(), inventoryFormat)
+	},
+}
+
+func init() {
+	inventoryCmd.Flags().StringVarP(&inventoryFormat, "output", "o", migration.InventoryFormatTable, fmt.Sprintf("output format, one of %v", migration.InventoryFormats()))
+	rootCmd.AddCommand(inventoryCmd)
+}
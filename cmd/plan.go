@@ -0,0 +1,41 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// planCmd prints the operations of the migration without running them
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Print the operations of the migration without running them",
+	Long: `Resolve every PVC, PV and rbd image which would be migrated and print the
+ordered list of Kubernetes and rbd operations the migration would run, without
+changing anything. The command fails if any precondition of the migration
+isn't met. It is the same as running the migration with --dry-run.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := migrationOptions()
+		opts.DryRun = true
+		return migration.MigrateToCSI(opts)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+}
@@ -0,0 +1,40 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// purgeTrashCmd removes the expired placeholder images from the rbd trash
+var purgeTrashCmd = &cobra.Command{
+	Use:   "purge-trash",
+	Short: "Purge the placeholder CSI images moved to the rbd trash",
+	Long: `Remove from the trash of the pool of the destination storageclass the
+placeholder CSI images the migration moved there, once their deferment period
+set by --trash-delay has expired. The other images of the trash are left
+untouched.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.PurgeTrash(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(purgeTrashCmd)
+}
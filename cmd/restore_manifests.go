@@ -0,0 +1,42 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// restoreManifestsCmd re-applies the manifests saved before the PVs and PVCs were changed
+var restoreManifestsCmd = &cobra.Command{
+	Use:   "restore-manifests",
+	Short: "Re-apply the manifests of the PVs and PVCs saved before the migration",
+	Long: `Recreate the PVs and PVCs from the manifests saved before the migration
+changed or deleted them, read from --backup-dir if it is set or from the
+backup ConfigMaps otherwise. Existing objects are left untouched, and the PVCs
+whose migration is recorded in the journal or completed are skipped unless
+--force is set.
+Use --pvc and --pvc-ns to restore the manifests of a single PVC.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.RestoreManifests(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreManifestsCmd)
+}
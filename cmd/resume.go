@@ -0,0 +1,38 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// resumeCmd continues the migrations which were interrupted before completion
+var resumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume interrupted PVC migrations",
+	Long: `Resume the PVC migrations recorded in the migration journal which were
+interrupted before completion. Every migration continues from the last step
+it completed. Use --pvc and --pvc-ns to resume a single PVC.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.ResumeMigration(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+}
@@ -0,0 +1,39 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// rollbackCmd restores the original PVC and PV of the migrations which did not complete
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Rollback interrupted PVC migrations",
+	Long: `Rollback the PVC migrations recorded in the migration journal which did not
+complete. The CSI PVC and PV are deleted, the rbd image is renamed back to its
+original name and the original PV and PVC are recreated and bound again. Use
+--pvc and --pvc-ns to rollback a single PVC.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.RollbackMigration(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+}
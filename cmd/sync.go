@@ -0,0 +1,40 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"persistent-volume-migrator/pkg/migration"
+
+	"github.com/spf13/cobra"
+)
+
+// syncCmd copies the rbd images to the destination cluster ahead of the migration
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Copy the rbd images to the destination cluster ahead of the migration",
+	Long: `Copy the rbd images of the PVCs from the cluster given by --source-cluster-id
+to the cluster of the destination storageclass, while the volumes are still in
+use. Every run copies the changes since the previous one, so that the migration
+only has to copy the last changes once the workloads are stopped.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migration.SyncImages(migrationOptions())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+}
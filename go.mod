@@ -3,12 +3,15 @@ module persistent-volume-migrator
 go 1.16
 
 require (
+	github.com/ceph/go-ceph v0.12.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/spf13/cobra v1.1.3
 	k8s.io/api v0.20.0
 	k8s.io/apimachinery v0.20.0
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	k8s.io/klog/v2 v2.4.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
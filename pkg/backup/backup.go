@@ -0,0 +1,342 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backup saves the manifests of the objects changed by the migration,
+// so that they can be re-applied if the migration goes wrong.
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configMapPrefix is the prefix of the ConfigMaps holding the backups,
+	// followed by the UID of the migrated PVC.
+	configMapPrefix = "persistent-volume-migrator-backup-"
+	// LabelBackup is the label of the ConfigMaps holding the backups.
+	LabelBackup = "persistent-volume-migrator/backup"
+	// annPVCName and annPVCNamespace are the annotations of the ConfigMaps
+	// holding the name and namespace of the migrated PVC.
+	annPVCName      = "persistent-volume-migrator/pvc-name"
+	annPVCNamespace = "persistent-volume-migrator/pvc-namespace"
+	// annCompleted marks the ConfigMaps of the migrations which completed.
+	annCompleted = "persistent-volume-migrator/completed"
+
+	pvKeyPrefix  = "pv-"
+	pvcKeyPrefix = "pvc-"
+	keySuffix    = ".yaml"
+	// completedFile marks the backup directories of the migrations which
+	// completed.
+	completedFile = "completed"
+)
+
+// Group identifies the migrated PVC the objects are changed for.
+type Group struct {
+	UID       string
+	Namespace string
+	Name      string
+}
+
+// Backup holds the manifests saved for the migration of a PVC.
+type Backup struct {
+	Group
+	PVs  []*corev1.PersistentVolume
+	PVCs []*corev1.PersistentVolumeClaim
+	// Completed is true if the migration of the PVC completed, the objects
+	// of the manifests being replaced by the migrated ones.
+	Completed bool
+}
+
+// Store saves the manifests in a ConfigMap per migrated PVC and, if dir is
+// set, in a directory per migrated PVC under dir. Only the first manifest
+// saved for an object is kept, so that the original object can be restored.
+type Store struct {
+	client    *k8s.Clientset
+	namespace string
+	dir       string
+	// mu serializes the updates of the backups by the migration workers.
+	mu sync.Mutex
+}
+
+func NewStore(client *k8s.Clientset, namespace, dir string) *Store {
+	return &Store{
+		client:    client,
+		namespace: namespace,
+		dir:       dir,
+	}
+}
+
+// SavePV saves the manifest of the PV, without its server-managed fields.
+func (s *Store) SavePV(g Group, pv *corev1.PersistentVolume) error {
+	obj := pv.DeepCopy()
+	obj.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"}
+	obj.ObjectMeta = cleanObjectMeta(obj.ObjectMeta)
+	obj.Status = corev1.PersistentVolumeStatus{}
+	return s.save(g, pvKeyPrefix+obj.Name+keySuffix, obj)
+}
+
+// SavePVC saves the manifest of the PVC, without its server-managed fields.
+func (s *Store) SavePVC(g Group, pvc *corev1.PersistentVolumeClaim) error {
+	obj := pvc.DeepCopy()
+	obj.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+	obj.ObjectMeta = cleanObjectMeta(obj.ObjectMeta)
+	obj.Status = corev1.PersistentVolumeClaimStatus{}
+	return s.save(g, pvcKeyPrefix+obj.Name+keySuffix, obj)
+}
+
+// cleanObjectMeta returns the metadata of an object without the fields set
+// by the server.
+func cleanObjectMeta(meta metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            meta.Name,
+		Namespace:       meta.Namespace,
+		Labels:          meta.Labels,
+		Annotations:     meta.Annotations,
+		Finalizers:      meta.Finalizers,
+		OwnerReferences: meta.OwnerReferences,
+	}
+}
+
+func (s *Store) save(g Group, key string, obj interface{}) error {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to serialize %s: %w", key, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		if err = s.saveFile(g, key, data); err != nil {
+			return err
+		}
+	}
+	return s.saveConfigMap(g, key, data)
+}
+
+func (s *Store) saveFile(g Group, key string, data []byte) error {
+	dir := filepath.Join(s.dir, g.UID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create backup directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write backup file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *Store) saveConfigMap(g Group, key string, data []byte) error {
+	name := configMapPrefix + g.UID
+	cm, err := k8sutil.GetConfigMap(s.client, s.namespace, name)
+	if apierrs.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   s.namespace,
+				Labels:      map[string]string{LabelBackup: "true"},
+				Annotations: map[string]string{annPVCName: g.Name, annPVCNamespace: g.Namespace},
+			},
+			Data: map[string]string{key: string(data)},
+		}
+		err = k8sutil.CreateConfigMap(s.client, cm)
+		if err != nil {
+			return fmt.Errorf("failed to create backup configmap %s: %w", name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get backup configmap %s: %w", name, err)
+	}
+	if _, ok := cm.Data[key]; ok {
+		return nil
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[key] = string(data)
+	err = k8sutil.UpdateConfigMap(s.client, cm)
+	if err != nil {
+		return fmt.Errorf("failed to update backup configmap %s: %w", name, err)
+	}
+	return nil
+}
+
+// Complete records that the migration of the PVC completed. The backup is
+// kept, its ConfigMap is annotated and its directory, if the store has one,
+// gets a marker file.
+func (s *Store) Complete(g Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		dir := filepath.Join(s.dir, g.UID)
+		if _, err := os.Stat(dir); err == nil {
+			path := filepath.Join(dir, completedFile)
+			if err = ioutil.WriteFile(path, nil, 0o600); err != nil {
+				return fmt.Errorf("failed to write backup file %s: %w", path, err)
+			}
+		}
+	}
+	name := configMapPrefix + g.UID
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := k8sutil.GetConfigMap(s.client, s.namespace, name)
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Annotations[annCompleted] == "true" {
+			return nil
+		}
+		metav1.SetMetaDataAnnotation(&cm.ObjectMeta, annCompleted, "true")
+		return k8sutil.UpdateConfigMap(s.client, cm)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark backup configmap %s completed: %w", name, err)
+	}
+	return nil
+}
+
+// Remove removes the backup of the PVC, its ConfigMap and its directory.
+func (s *Store) Remove(g Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		dir := filepath.Join(s.dir, g.UID)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove backup directory %s: %w", dir, err)
+		}
+	}
+	name := configMapPrefix + g.UID
+	if err := k8sutil.DeleteConfigMap(s.client, s.namespace, name); err != nil {
+		return fmt.Errorf("failed to delete backup configmap %s: %w", name, err)
+	}
+	return nil
+}
+
+// List returns the backups, read from the directory of the store if it is
+// set, or from the ConfigMaps otherwise.
+func (s *Store) List() ([]*Backup, error) {
+	if s.dir != "" {
+		return s.listFiles()
+	}
+	return s.listConfigMaps()
+}
+
+func (s *Store) listConfigMaps() ([]*Backup, error) {
+	cms, err := k8sutil.ListConfigMaps(s.client, s.namespace, LabelBackup+"=true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup configmaps: %w", err)
+	}
+	backups := []*Backup{}
+	for _, cm := range cms {
+		b := &Backup{Group: Group{
+			UID:       strings.TrimPrefix(cm.Name, configMapPrefix),
+			Namespace: cm.Annotations[annPVCNamespace],
+			Name:      cm.Annotations[annPVCName],
+		}, Completed: cm.Annotations[annCompleted] == "true"}
+		for key, data := range cm.Data {
+			if err = b.add(key, []byte(data)); err != nil {
+				return nil, fmt.Errorf("failed to parse %s of backup configmap %s: %w", key, cm.Name, err)
+			}
+		}
+		backups = append(backups, b.sorted())
+	}
+	return backups, nil
+}
+
+func (s *Store) listFiles() ([]*Backup, error) {
+	dirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory %s: %w", s.dir, err)
+	}
+	backups := []*Backup{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		b := &Backup{Group: Group{UID: d.Name()}}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, d.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup directory %s: %w", d.Name(), err)
+		}
+		for _, f := range files {
+			if f.Name() == completedFile {
+				b.Completed = true
+				continue
+			}
+			path := filepath.Join(s.dir, d.Name(), f.Name())
+			data, err := ioutil.ReadFile(path) // #nosec G304 the backup directory is given by the user.
+			if err != nil {
+				return nil, fmt.Errorf("failed to read backup file %s: %w", path, err)
+			}
+			if err = b.add(f.Name(), data); err != nil {
+				return nil, fmt.Errorf("failed to parse backup file %s: %w", path, err)
+			}
+		}
+		// the group of a backup read from files is the one of its PVC.
+		for _, pvc := range b.PVCs {
+			b.Namespace, b.Name = pvc.Namespace, pvc.Name
+		}
+		backups = append(backups, b.sorted())
+	}
+	return backups, nil
+}
+
+// add parses the manifest saved under the key. Keys of other objects are
+// ignored.
+func (b *Backup) add(key string, data []byte) error {
+	switch {
+	case strings.HasPrefix(key, pvcKeyPrefix) && strings.HasSuffix(key, keySuffix):
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := yaml.Unmarshal(data, pvc); err != nil {
+			return err
+		}
+		b.PVCs = append(b.PVCs, pvc)
+	case strings.HasPrefix(key, pvKeyPrefix) && strings.HasSuffix(key, keySuffix):
+		pv := &corev1.PersistentVolume{}
+		if err := yaml.Unmarshal(data, pv); err != nil {
+			return err
+		}
+		b.PVs = append(b.PVs, pv)
+	}
+	return nil
+}
+
+// sorted sorts the manifests by name, so that they are restored in the same
+// order whatever they were read from.
+func (b *Backup) sorted() *Backup {
+	sort.Slice(b.PVs, func(i, k int) bool { return b.PVs[i].Name < b.PVs[k].Name })
+	sort.Slice(b.PVCs, func(i, k int) bool { return b.PVCs[i].Name < b.PVCs[k].Name })
+	return b
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cephfs manages the CephFS file systems of a ceph cluster.
+package cephfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"persistent-volume-migrator/pkg/ceph"
+	logger "persistent-volume-migrator/pkg/log"
+)
+
+// Connection runs ceph commands against the cluster with the credentials of
+// a ceph user.
+type Connection struct {
+	Monitors string
+	ID       string
+	keyFile  *ceph.KeyFile
+}
+
+// NewConnection creates a connection to the cluster with the given monitors.
+func NewConnection(monitor, id, key string) (*Connection, error) {
+	keyFile, err := ceph.StoreKey(key)
+	if err != nil {
+		return nil, err
+	}
+	logger.DefaultLog("New cephfs connection arg monitors: %s, id: %s", monitor, id)
+	return &Connection{
+		Monitors: monitor,
+		ID:       id,
+		keyFile:  keyFile,
+	}, nil
+}
+
+// Close removes the keyfile of the connection. The connection can't be used
+// once closed.
+func (c *Connection) Close() error {
+	return c.keyFile.Remove()
+}
+
+func (c *Connection) run(action string, args ...string) ([]byte, error) {
+	args = append(args, "--id", c.ID, "-m", c.Monitors, "--keyfile="+c.keyFile.Path)
+	// #nosec
+	output, err := exec.Command("ceph", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s: %w, command output: %s", action, err, string(output))
+	}
+	return output, nil
+}
+
+// FileSystems returns the names of the CephFS file systems of the cluster.
+func (c *Connection) FileSystems() ([]string, error) {
+	output, err := c.run("list cephfs file systems", "fs", "ls", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var fileSystems []struct {
+		Name string `json:"name"`
+	}
+	if err = json.Unmarshal(output, &fileSystems); err != nil {
+		return nil, fmt.Errorf("failed to parse cephfs file systems: %w", err)
+	}
+	names := []string{}
+	for _, fs := range fileSystems {
+		names = append(names, fs.Name)
+	}
+	return names, nil
+}
+
+// FileSystemExists checks whether the file system with the given name exists.
+func (c *Connection) FileSystemExists(name string) (bool, error) {
+	names, err := c.FileSystems()
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
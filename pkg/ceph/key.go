@@ -0,0 +1,111 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ceph holds the helpers shared by the connections to the ceph
+// cluster.
+package ceph
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	// memoryKeyDir is the tmpfs the keys are stored in, so that they are
+	// never written to disk. The temporary directory is used if it doesn't
+	// exist.
+	memoryKeyDir         = "/dev/shm"
+	tmpKeyFileNamePrefix = "pv-migrator-key-"
+)
+
+var (
+	keysMu sync.Mutex
+	// keys holds the paths of the keyfiles which haven't been removed yet.
+	keys = map[string]struct{}{}
+)
+
+// KeyFile is a temporary file, readable only by the current user, holding
+// the key of a single connection.
+type KeyFile struct {
+	Path string
+}
+
+// keyDir returns the directory the keyfiles are created in.
+func keyDir() string {
+	if info, err := os.Stat(memoryKeyDir); err == nil && info.IsDir() {
+		return memoryKeyDir
+	}
+	return os.TempDir()
+}
+
+// StoreKey writes the key to a new keyfile. The keyfile must be removed once
+// the connection is closed.
+func StoreKey(key string) (*KeyFile, error) {
+	// the file is created with the 0600 permissions.
+	tmpfile, err := ioutil.TempFile(keyDir(), tmpKeyFileNamePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error creating a temporary keyfile: %w", err)
+	}
+	keyFile := &KeyFile{Path: tmpfile.Name()}
+	keysMu.Lock()
+	keys[keyFile.Path] = struct{}{}
+	keysMu.Unlock()
+
+	_, err = tmpfile.Write([]byte(key))
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// don't complain about unhandled error
+		_ = keyFile.Remove()
+		return nil, fmt.Errorf("error writing key to temporary keyfile: %w", err)
+	}
+	return keyFile, nil
+}
+
+// Remove removes the keyfile. It can be called more than once.
+func (k *KeyFile) Remove() error {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	return removeKey(k.Path)
+}
+
+// removeKey removes the keyfile with the given path, keysMu must be held.
+func removeKey(path string) error {
+	if _, ok := keys[path]; !ok {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove keyfile %s: %w", path, err)
+	}
+	delete(keys, path)
+	return nil
+}
+
+// RemoveKeys removes the keyfiles of the connections which weren't closed.
+func RemoveKeys() error {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	var lastErr error
+	for path := range keys {
+		if err := removeKey(path); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
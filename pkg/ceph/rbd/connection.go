@@ -17,7 +17,9 @@ limitations under the License.
 package rbd
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"io"
 
 	logger "persistent-volume-migrator/pkg/log"
 )
@@ -25,27 +27,81 @@ import (
 type Connection struct {
 	Monitors string
 	ID       string
-	KeyFile  string
 	Pool     string
 	DataPool string
+	// key is only handed to the backend, which decides how the cephx key
+	// is passed to ceph.
+	key string
+	// ImageManager manages the images with the credentials of the connection.
+	ImageManager
 }
 
-func NewConnection(monitor, id, key, pool, datapool string) (*Connection, error) {
-	keyfile, err := storeKey(key)
-	if err != nil {
-		return nil, err
-	}
-	logger.DefaultLog("New connection arg monitors: %s, id: %s, keyfile: %s, pool: %s, datapool: %s", monitor, id, keyfile, pool, datapool)
-	return &Connection{
+// NewConnection creates a connection using the given rbd backend, the exec
+// backend is used if backend is empty.
+func NewConnection(monitor, id, key, pool, datapool, backend string) (*Connection, error) {
+	logger.DefaultLog("New connection arg monitors: %s, id: %s, pool: %s, datapool: %s, backend: %s", monitor, id, pool, datapool, backend)
+	conn := &Connection{
 		Monitors: monitor,
 		ID:       id,
-		KeyFile:  keyfile,
 		Pool:     pool,
 		DataPool: datapool,
-	}, nil
+		key:      key,
+	}
+	var err error
+	conn.ImageManager, err = newImageManager(backend, conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close releases the key material of the connection. The connection can't
+// be used once closed.
+func (r *Connection) Close() error {
+	if c, ok := r.ImageManager.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
-func RemoveKeyDir() error {
-	// remove the directory which was created specially for storing key. This will also remove key file.
-	return os.RemoveAll("/tmp/csi/keys")
+// RenameVolume renames the volume with given name
+func (r *Connection) RenameVolume(newImageName, oldImageName string) error {
+	return r.Rename(r.Pool, oldImageName, newImageName)
+}
+
+// ImageExists checks whether the image with given name exists in the pool.
+func (r *Connection) ImageExists(imageName string) (bool, error) {
+	_, err := r.Stat(r.Pool, imageName)
+	if errors.Is(err, ErrImageNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CopyDiff streams the changes of the source image between the fromSnap and
+// toSnap snapshots, or all of its data up to toSnap if fromSnap is empty, to
+// the destination image, which can be in another cluster. The destination
+// image must exist, and must have the fromSnap snapshot if it is set.
+func CopyDiff(src *Connection, srcPool, srcImageName, fromSnap, toSnap string, dst *Connection, dstPool, dstImageName string) error {
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		err := src.ExportDiff(srcPool, srcImageName, fromSnap, toSnap, pw)
+		_ = pw.CloseWithError(err)
+		exported <- err
+	}()
+
+	importErr := dst.ImportDiff(dstPool, dstImageName, pr)
+	// unblock the export if the import stopped reading.
+	_ = pr.CloseWithError(importErr)
+	if err := <-exported; err != nil {
+		return fmt.Errorf("failed to export rbd image %s/%s: %w", srcPool, srcImageName, err)
+	}
+	if importErr != nil {
+		return fmt.Errorf("failed to import rbd image %s/%s: %w", dstPool, dstImageName, importErr)
+	}
+	return nil
 }
@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// ExecBackend manages the images by running the rbd command line tool.
+	ExecBackend = "exec"
+	// NativeBackend manages the images through librbd and librados. It is only
+	// available in binaries built with the ceph_native build tag.
+	NativeBackend = "native"
+)
+
+var (
+	// ErrImageNotFound is returned when the rbd image doesn't exist.
+	ErrImageNotFound = errors.New("rbd image not found")
+	// ErrImageBusy is returned when the rbd image is in use, for example
+	// because it still has watchers.
+	ErrImageBusy = errors.New("rbd image is busy")
+	// ErrNotSupported is returned when the operation isn't supported by the
+	// backend.
+	ErrNotSupported = errors.New("operation not supported by the rbd backend")
+	// ErrTrashNotExpired is returned when an image is removed from the trash
+	// before the end of its deferment period.
+	ErrTrashNotExpired = errors.New("deferment period of the trashed rbd image has not expired")
+)
+
+const (
+	// MigrationPrepared is the state of a live migration whose target image
+	// was created, before the data is copied.
+	MigrationPrepared = "prepared"
+	// MigrationExecuting is the state of a live migration while the data is
+	// copied.
+	MigrationExecuting = "executing"
+	// MigrationExecuted is the state of a live migration whose data was
+	// copied, before it is committed.
+	MigrationExecuted = "executed"
+)
+
+// ImageInfo holds the details of an rbd image.
+type ImageInfo struct {
+	Name     string
+	Pool     string
+	Size     uint64
+	Features []string
+}
+
+// Watcher is a client watching an rbd image, usually because it has the image
+// mapped.
+type Watcher struct {
+	Address string
+	Cookie  uint64
+}
+
+// TrashEntry is an image in the trash of a pool.
+type TrashEntry struct {
+	ID   string
+	Name string
+}
+
+// CreateOptions holds the settings of a new image. The defaults of the
+// cluster are used for the ones which are empty.
+type CreateOptions struct {
+	// Features are the names of the features of the image, like layering.
+	Features []string
+	// DataPool is the pool the data of the image is stored in.
+	DataPool string
+}
+
+// ImageManager manages the rbd images of a ceph cluster.
+type ImageManager interface {
+	// Rename renames the image in the pool.
+	Rename(pool, oldImageName, newImageName string) error
+	// Remove removes the image from the pool.
+	Remove(pool, imageName string) error
+	// Stat returns the details of the image.
+	Stat(pool, imageName string) (*ImageInfo, error)
+	// Create creates an image of the given size in bytes.
+	Create(pool, imageName string, size uint64, options CreateOptions) error
+	// CreateSnapshot creates a snapshot of the image.
+	CreateSnapshot(pool, imageName, snapName string) error
+	// RemoveSnapshot removes a snapshot of the image.
+	RemoveSnapshot(pool, imageName, snapName string) error
+	// ExportDiff writes to w the changes of the image between the fromSnap
+	// and toSnap snapshots, or all of its data up to toSnap if fromSnap is
+	// empty, in the rbd diff format.
+	ExportDiff(pool, imageName, fromSnap, toSnap string, w io.Writer) error
+	// ImportDiff applies the changes read from r, in the rbd diff format, to
+	// the image, and creates the snapshot they end at.
+	ImportDiff(pool, imageName string, r io.Reader) error
+	// ListWatchers returns the clients watching the image.
+	ListWatchers(pool, imageName string) ([]Watcher, error)
+	// PrepareMigration starts the live migration of the source image to the
+	// target image, which can be in another pool and is created with the
+	// given options.
+	PrepareMigration(srcPool, srcImageName, dstPool, dstImageName string, options CreateOptions) error
+	// ExecuteMigration copies the data of the source image of the live
+	// migration to the target image. progress is called with the percentage
+	// of the data copied.
+	ExecuteMigration(pool, imageName string, progress func(percent int)) error
+	// CommitMigration completes the live migration of the target image and
+	// removes the source image.
+	CommitMigration(pool, imageName string) error
+	// AbortMigration cancels the live migration of the target image and
+	// restores the source image.
+	AbortMigration(pool, imageName string) error
+	// MigrationState returns the state of the live migration of the target
+	// image, or an empty string if the image isn't being migrated.
+	MigrationState(pool, imageName string) (string, error)
+	// MoveToTrash moves the image to the trash of the pool, from which it
+	// can't be removed before the end of the delay.
+	MoveToTrash(pool, imageName string, delay time.Duration) error
+	// ListTrash returns the images in the trash of the pool.
+	ListTrash(pool string) ([]TrashEntry, error)
+	// RemoveFromTrash removes the image with the given id from the trash of
+	// the pool. It returns ErrTrashNotExpired if the deferment period of the
+	// image has not expired.
+	RemoveFromTrash(pool, id string) error
+}
+
+// imageManagers holds the constructors of the available backends.
+var imageManagers = map[string]func(*Connection) (ImageManager, error){
+	ExecBackend: newExecImageManager,
+}
+
+// Backends returns the names of the backends available in this build.
+func Backends() []string {
+	names := []string{}
+	for name := range imageManagers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newImageManager(backend string, conn *Connection) (ImageManager, error) {
+	if backend == "" {
+		backend = ExecBackend
+	}
+	newManager, ok := imageManagers[backend]
+	if !ok {
+		return nil, fmt.Errorf("rbd backend %q is not available, available backends: %v", backend, Backends())
+	}
+	return newManager(conn)
+}
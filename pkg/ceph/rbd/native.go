@@ -0,0 +1,269 @@
+//go:build ceph_native
+// +build ceph_native
+
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"persistent-volume-migrator/pkg/metrics"
+
+	"github.com/ceph/go-ceph/rados"
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+func init() {
+	imageManagers[NativeBackend] = newNativeImageManager
+}
+
+// nativeImageManager manages the images through librbd and librados with the
+// credentials of the connection.
+type nativeImageManager struct {
+	conn *Connection
+}
+
+func newNativeImageManager(conn *Connection) (ImageManager, error) {
+	return &nativeImageManager{conn: conn}, nil
+}
+
+// withIOContext connects to the cluster, opens the pool and runs fn. The
+// cluster connection is shut down once fn returns.
+func (n *nativeImageManager) withIOContext(pool string, fn func(ioctx *rados.IOContext) error) error {
+	conn, err := rados.NewConnWithUser(n.conn.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create rados connection: %w", err)
+	}
+	if err = conn.SetConfigOption("mon_host", n.conn.Monitors); err != nil {
+		return fmt.Errorf("failed to set monitors: %w", err)
+	}
+	// the key is passed in memory, without a keyfile.
+	if err = conn.SetConfigOption("key", n.conn.key); err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+	if err = conn.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to the ceph cluster: %w", err)
+	}
+	defer conn.Shutdown()
+
+	ioctx, err := conn.OpenIOContext(pool)
+	if err != nil {
+		return fmt.Errorf("failed to open pool %s: %w", pool, err)
+	}
+	defer ioctx.Destroy()
+
+	err = convertError(fn(ioctx))
+	if err != nil {
+		metrics.RBDErrors.WithLabelValues("librbd").Inc()
+	}
+	return err
+}
+
+// convertError converts the librbd errors to the errors of this package.
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, librbd.ErrNotFound) || errors.Is(err, librbd.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrImageNotFound, err)
+	}
+	var errno interface{ ErrorCode() int }
+	if errors.As(err, &errno) {
+		switch -errno.ErrorCode() {
+		case int(syscall.ENOENT):
+			return fmt.Errorf("%w: %v", ErrImageNotFound, err)
+		case int(syscall.EBUSY):
+			return fmt.Errorf("%w: %v", ErrImageBusy, err)
+		}
+	}
+	return err
+}
+
+func (n *nativeImageManager) Rename(pool, oldImageName, newImageName string) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		return librbd.GetImage(ioctx, oldImageName).Rename(newImageName)
+	})
+}
+
+func (n *nativeImageManager) Remove(pool, imageName string) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		return librbd.RemoveImage(ioctx, imageName)
+	})
+}
+
+func (n *nativeImageManager) Stat(pool, imageName string) (*ImageInfo, error) {
+	var info *ImageInfo
+	err := n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		image, err := librbd.OpenImageReadOnly(ioctx, imageName, librbd.NoSnapshot)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+
+		stat, err := image.Stat()
+		if err != nil {
+			return err
+		}
+		features, err := image.GetFeatures()
+		if err != nil {
+			return err
+		}
+		featureSet := librbd.FeatureSet(features)
+		info = &ImageInfo{
+			Name:     imageName,
+			Pool:     pool,
+			Size:     stat.Size,
+			Features: featureSet.Names(),
+		}
+		return nil
+	})
+	return info, err
+}
+
+func (n *nativeImageManager) Create(pool, imageName string, size uint64, options CreateOptions) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		imageOptions := librbd.NewRbdImageOptions()
+		defer imageOptions.Destroy()
+		if len(options.Features) > 0 {
+			features := librbd.FeatureSetFromNames(options.Features)
+			if err := imageOptions.SetUint64(librbd.ImageOptionFeatures, uint64(features)); err != nil {
+				return err
+			}
+		}
+		if options.DataPool != "" {
+			if err := imageOptions.SetString(librbd.ImageOptionDataPool, options.DataPool); err != nil {
+				return err
+			}
+		}
+		return librbd.CreateImage(ioctx, imageName, size, imageOptions)
+	})
+}
+
+func (n *nativeImageManager) RemoveSnapshot(pool, imageName, snapName string) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		image, err := librbd.OpenImage(ioctx, imageName, librbd.NoSnapshot)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+
+		return image.GetSnapshot(snapName).Remove()
+	})
+}
+
+// The rbd diff format isn't available in this version of go-ceph.
+
+func (n *nativeImageManager) ExportDiff(pool, imageName, fromSnap, toSnap string, w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) ImportDiff(pool, imageName string, r io.Reader) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) CreateSnapshot(pool, imageName, snapName string) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		image, err := librbd.OpenImage(ioctx, imageName, librbd.NoSnapshot)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+
+		_, err = image.CreateSnapshot(snapName)
+		return err
+	})
+}
+
+func (n *nativeImageManager) ListWatchers(pool, imageName string) ([]Watcher, error) {
+	watchers := []Watcher{}
+	err := n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		image, err := librbd.OpenImageReadOnly(ioctx, imageName, librbd.NoSnapshot)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+
+		imageWatchers, err := image.ListWatchers()
+		if err != nil {
+			return err
+		}
+		for _, w := range imageWatchers {
+			watchers = append(watchers, Watcher{Address: w.Addr, Cookie: w.Cookie})
+		}
+		return nil
+	})
+	return watchers, err
+}
+
+// The live migration of images isn't available in this version of go-ceph.
+
+func (n *nativeImageManager) PrepareMigration(srcPool, srcImageName, dstPool, dstImageName string, options CreateOptions) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) ExecuteMigration(pool, imageName string, progress func(percent int)) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) CommitMigration(pool, imageName string) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) AbortMigration(pool, imageName string) error {
+	return ErrNotSupported
+}
+
+func (n *nativeImageManager) MigrationState(pool, imageName string) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (n *nativeImageManager) MoveToTrash(pool, imageName string, delay time.Duration) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		return librbd.GetImage(ioctx, imageName).Trash(delay)
+	})
+}
+
+func (n *nativeImageManager) ListTrash(pool string) ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	err := n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		trash, err := librbd.GetTrashList(ioctx)
+		if err != nil {
+			return err
+		}
+		for _, t := range trash {
+			entries = append(entries, TrashEntry{ID: t.Id, Name: t.Name})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (n *nativeImageManager) RemoveFromTrash(pool, id string) error {
+	return n.withIOContext(pool, func(ioctx *rados.IOContext) error {
+		err := librbd.TrashRemove(ioctx, id, false)
+		var errno interface{ ErrorCode() int }
+		if errors.As(err, &errno) && -errno.ErrorCode() == int(syscall.EPERM) {
+			return fmt.Errorf("%w: %v", ErrTrashNotExpired, err)
+		}
+		return err
+	})
+}
@@ -17,87 +17,336 @@ limitations under the License.
 package rbd
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"io"
 	"os/exec"
-)
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
-const (
-	tmpKeyFileLocation   = "/tmp/csi/keys"
-	tmpKeyFileNamePrefix = "keyfile-"
+	"persistent-volume-migrator/pkg/ceph"
+	"persistent-volume-migrator/pkg/metrics"
 )
 
-func storeKey(key string) (string, error) {
-	err := os.MkdirAll(tmpKeyFileLocation, 0700)
+func execCommand(command string, args []string) ([]byte, error) {
+	// #nosec
+	cmd := exec.Command(command, args...)
+	return cmd.CombinedOutput()
+}
+
+// commandError is returned when an rbd command fails. It matches
+// ErrImageNotFound and ErrImageBusy with errors.Is when the command output
+// reports the corresponding failure.
+type commandError struct {
+	action string
+	err    error
+	output string
+}
+
+// newCommandError returns the error of the rbd command run with args, and
+// counts it in the rbd error metric.
+func newCommandError(action string, args []string, err error, output string) *commandError {
+	metrics.RBDErrors.WithLabelValues(rbdCommand(args)).Inc()
+	return &commandError{action: action, err: err, output: output}
+}
+
+// rbdCommand returns the rbd command run with args, like "rename" or
+// "snap create".
+func rbdCommand(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch args[0] {
+	case "snap", "trash", "migration":
+		if len(args) > 1 {
+			return args[0] + " " + args[1]
+		}
+	}
+	return args[0]
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%v. failed to %s, command output: %s", e.err, e.action, e.output)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+func (e *commandError) Is(target error) bool {
+	switch target {
+	case ErrImageNotFound:
+		return strings.Contains(e.output, "No such file or directory")
+	case ErrImageBusy:
+		return strings.Contains(e.output, "image still has watchers") ||
+			strings.Contains(e.output, "Device or resource busy")
+	case ErrTrashNotExpired:
+		return strings.Contains(strings.ToLower(e.output), "deferment time has not expired")
+	}
+	return false
+}
+
+// execImageManager manages the images by running the rbd command line tool
+// with the credentials of the connection.
+type execImageManager struct {
+	conn *Connection
+	// keyFile holds the key of the connection, as the rbd command only
+	// reads it from a file without showing it in its arguments.
+	keyFile *ceph.KeyFile
+}
+
+func newExecImageManager(conn *Connection) (ImageManager, error) {
+	keyFile, err := ceph.StoreKey(conn.key)
 	if err != nil {
-		return "", fmt.Errorf("error creating a temporary directory %s: %w", tmpKeyFileLocation, err)
+		return nil, err
 	}
+	return &execImageManager{conn: conn, keyFile: keyFile}, nil
+}
+
+// Close removes the keyfile of the connection.
+func (e *execImageManager) Close() error {
+	return e.keyFile.Remove()
+}
 
-	tmpfile, err := ioutil.TempFile(tmpKeyFileLocation, tmpKeyFileNamePrefix)
+// args appends the connection arguments to the rbd command arguments.
+func (e *execImageManager) args(args ...string) []string {
+	return append(args, "--id", e.conn.ID, "-m", e.conn.Monitors, "--keyfile="+e.keyFile.Path)
+}
+
+// run runs the rbd command with the connection arguments appended.
+func (e *execImageManager) run(action string, args ...string) ([]byte, error) {
+	output, err := execCommand("rbd", e.args(args...))
 	if err != nil {
-		return "", fmt.Errorf("error creating a temporary keyfile: %w", err)
+		return nil, newCommandError(action, args, err, string(output))
 	}
-	defer func() {
-		if err != nil {
-			// don't complain about unhandled error
-			_ = os.Remove(tmpfile.Name())
-		}
-	}()
+	return output, nil
+}
 
-	if _, err = tmpfile.Write([]byte(key)); err != nil {
-		return "", fmt.Errorf("error writing key to temporary keyfile: %w", err)
+func (e *execImageManager) Rename(pool, oldImageName, newImageName string) error {
+	args := []string{"rename", oldImageName, newImageName, "--pool", pool}
+	if e.conn.DataPool != "" {
+		args = append(args, "--data-pool", e.conn.DataPool)
 	}
+	_, err := e.run("rename rbd image", args...)
+	return err
+}
 
-	keyFile := tmpfile.Name()
-	if keyFile == "" {
-		err = fmt.Errorf("error reading temporary filename for key: %w", err)
-		return "", err
+func (e *execImageManager) Remove(pool, imageName string) error {
+	_, err := e.run("remove rbd image", "rm", imageName, "--pool", pool)
+	return err
+}
+
+func (e *execImageManager) Stat(pool, imageName string) (*ImageInfo, error) {
+	output, err := e.run("get rbd image info", "info", imageName, "--pool", pool, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	info := struct {
+		Name     string   `json:"name"`
+		Size     uint64   `json:"size"`
+		Features []string `json:"features"`
+	}{}
+	if err = json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse rbd image info %q: %w", string(output), err)
 	}
+	return &ImageInfo{
+		Name:     info.Name,
+		Pool:     pool,
+		Size:     info.Size,
+		Features: info.Features,
+	}, nil
+}
 
-	if err = tmpfile.Close(); err != nil {
-		return "", fmt.Errorf("error closing temporary filename: %w", err)
+func (e *execImageManager) CreateSnapshot(pool, imageName, snapName string) error {
+	_, err := e.run("create rbd snapshot", "snap", "create", fmt.Sprintf("%s/%s@%s", pool, imageName, snapName))
+	return err
+}
+
+func (e *execImageManager) Create(pool, imageName string, size uint64, options CreateOptions) error {
+	args := []string{"create", imageName, "--pool", pool, "--size", fmt.Sprintf("%dB", size)}
+	if len(options.Features) > 0 {
+		args = append(args, "--image-feature", strings.Join(options.Features, ","))
+	}
+	if options.DataPool != "" {
+		args = append(args, "--data-pool", options.DataPool)
 	}
+	_, err := e.run("create rbd image", args...)
+	return err
+}
 
-	return keyFile, nil
+func (e *execImageManager) RemoveSnapshot(pool, imageName, snapName string) error {
+	_, err := e.run("remove rbd snapshot", "snap", "rm", fmt.Sprintf("%s/%s@%s", pool, imageName, snapName))
+	return err
 }
 
-func execCommand(command string, args []string) ([]byte, error) {
-	// #nosec
-	cmd := exec.Command(command, args...)
-	return cmd.CombinedOutput()
+func (e *execImageManager) ExportDiff(pool, imageName, fromSnap, toSnap string, w io.Writer) error {
+	args := []string{"export-diff", fmt.Sprintf("%s/%s@%s", pool, imageName, toSnap), "-"}
+	if fromSnap != "" {
+		args = append(args, "--from-snap", fromSnap)
+	}
+	return e.stream("export rbd image diff", nil, w, args...)
 }
 
-// RenameVolume renames the volume with given name
-func (r *Connection) RenameVolume(newImageName, oldImageName string) error {
-	var output []byte
+func (e *execImageManager) ImportDiff(pool, imageName string, r io.Reader) error {
+	return e.stream("import rbd image diff", r, nil, "import-diff", "-", pool+"/"+imageName)
+}
 
-	args := []string{"rename", oldImageName, newImageName, "--pool", r.Pool, "--id", r.ID, "-m", r.Monitors, "--keyfile=" + r.KeyFile}
+// stream runs the rbd command with the connection arguments appended, and
+// with its standard input and output connected to r and w.
+func (e *execImageManager) stream(action string, r io.Reader, w io.Writer, args ...string) error {
+	// #nosec
+	cmd := exec.Command("rbd", e.args(args...)...)
+	var output bytes.Buffer
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return newCommandError(action, args, err, output.String())
+	}
+	return nil
+}
+
+func (e *execImageManager) ListWatchers(pool, imageName string) ([]Watcher, error) {
+	output, err := e.run("get rbd image status", "status", imageName, "--pool", pool, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	status := struct {
+		Watchers []struct {
+			Address string `json:"address"`
+			Cookie  uint64 `json:"cookie"`
+		} `json:"watchers"`
+	}{}
+	if err = json.Unmarshal(output, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse rbd image status %q: %w", string(output), err)
+	}
+	watchers := []Watcher{}
+	for _, w := range status.Watchers {
+		watchers = append(watchers, Watcher{Address: w.Address, Cookie: w.Cookie})
+	}
+	return watchers, nil
+}
 
-	if r.DataPool != "" {
-		args = append(args, "--data-pool", r.DataPool)
+func (e *execImageManager) PrepareMigration(srcPool, srcImageName, dstPool, dstImageName string, options CreateOptions) error {
+	args := []string{"migration", "prepare", srcPool + "/" + srcImageName, dstPool + "/" + dstImageName}
+	if len(options.Features) > 0 {
+		args = append(args, "--image-feature", strings.Join(options.Features, ","))
+	}
+	if options.DataPool != "" {
+		args = append(args, "--data-pool", options.DataPool)
 	}
-	output, err := execCommand("rbd", args)
+	_, err := e.run("prepare rbd image migration", args...)
+	return err
+}
 
+// migrationProgress matches the progress reported by rbd migration execute.
+var migrationProgress = regexp.MustCompile(`(\d+)% complete`)
+
+func (e *execImageManager) ExecuteMigration(pool, imageName string, progress func(percent int)) error {
+	args := e.args("migration", "execute", pool+"/"+imageName)
+	// #nosec
+	cmd := exec.Command("rbd", args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("%w. failed to rename rbd image, command output: %s", err, string(output))
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return newCommandError("execute rbd image migration", args, err, "")
+	}
+
+	// rbd rewrites the progress line with carriage returns.
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := migrationProgress.FindStringSubmatch(line); m != nil {
+			if percent, err := strconv.Atoi(m[1]); err == nil && progress != nil {
+				progress(percent)
+			}
+			continue
+		}
+		output.WriteString(line + "\n")
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return newCommandError("execute rbd image migration", args, err, output.String())
 	}
 	return nil
 }
 
-// RenameVolume renames the volume with given name
-func (r *Connection) RemoveVolumeAdmin(Pool, imageName string) error {
-	var output []byte
+func (e *execImageManager) CommitMigration(pool, imageName string) error {
+	_, err := e.run("commit rbd image migration", "migration", "commit", pool+"/"+imageName)
+	return err
+}
 
-	// args := []string{"rm", imageName, "--pool", r.Pool, "--id", r.ID, "-m", r.Monitors, "--keyfile=" + r.KeyFile}
-	args := []string{"-m", r.Monitors, "rm", imageName, "--pool", r.Pool, "-c", "/etc/ceph/ceph.conf"}
-	if r.DataPool != "" {
-		args = append(args, "--data-pool", r.DataPool)
+func (e *execImageManager) AbortMigration(pool, imageName string) error {
+	_, err := e.run("abort rbd image migration", "migration", "abort", pool+"/"+imageName)
+	return err
+}
+
+func (e *execImageManager) MigrationState(pool, imageName string) (string, error) {
+	output, err := e.run("get rbd image status", "status", imageName, "--pool", pool, "--format", "json")
+	if err != nil {
+		return "", err
+	}
+	status := struct {
+		Migration *struct {
+			State string `json:"state"`
+		} `json:"migration"`
+	}{}
+	if err = json.Unmarshal(output, &status); err != nil {
+		return "", fmt.Errorf("failed to parse rbd image status %q: %w", string(output), err)
 	}
-	output, err := execCommand("rbd", args)
+	if status.Migration == nil {
+		return "", nil
+	}
+	return status.Migration.State, nil
+}
+
+// trashTimeFormat is the format of the expiration time of rbd trash mv, which
+// is read as UTC.
+const trashTimeFormat = "2006-01-02 15:04:05"
+
+func (e *execImageManager) MoveToTrash(pool, imageName string, delay time.Duration) error {
+	expiresAt := time.Now().Add(delay).UTC().Format(trashTimeFormat)
+	_, err := e.run("move rbd image to trash", "trash", "mv", pool+"/"+imageName, "--expires-at", expiresAt)
+	return err
+}
 
+func (e *execImageManager) ListTrash(pool string) ([]TrashEntry, error) {
+	output, err := e.run("list rbd trash", "trash", "ls", "--pool", pool, "--format", "json")
 	if err != nil {
-		return fmt.Errorf("%w. failed to rename rbd image, command output: %s", err, string(output))
+		return nil, err
 	}
-	return nil
+	images := []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err = json.Unmarshal(output, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse rbd trash list %q: %w", string(output), err)
+	}
+	entries := []TrashEntry{}
+	for _, image := range images {
+		entries = append(entries, TrashEntry{ID: image.ID, Name: image.Name})
+	}
+	return entries, nil
+}
+
+func (e *execImageManager) RemoveFromTrash(pool, id string) error {
+	_, err := e.run("remove rbd image from trash", "trash", "rm", id, "--pool", pool)
+	return err
 }
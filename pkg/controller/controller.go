@@ -0,0 +1,340 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package controller runs the migrations declared by PersistentVolumeMigration
+// resources.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+	"persistent-volume-migrator/pkg/migration"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const resyncPeriod = 10 * time.Minute
+
+// Controller reconciles the PersistentVolumeMigration resources. The
+// migrations are run one at a time, as they share the journal and the
+// connections to the ceph cluster.
+type Controller struct {
+	// base holds the settings of the migrations which aren't set by the
+	// resources.
+	base     *migration.Options
+	client   dynamic.Interface
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// New creates the controller. The settings of opts are used for the options
+// the resources leave unset.
+func New(opts *migration.Options) (*Controller, error) {
+	client, err := k8sutil.NewDynamicClient(opts.KubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+	c := &Controller{
+		base:     opts,
+		client:   client,
+		informer: factory.ForResource(resource).Informer(),
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// the status updates don't change the generation and don't
+			// need a new reconciliation.
+			if oldObj.(metav1.Object).GetGeneration() != newObj.(metav1.Object).GetGeneration() {
+				c.enqueue(newObj)
+			}
+		},
+	})
+	return c, nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run reconciles the resources until the context is cancelled. A migration
+// which is running when the context is cancelled is completed first.
+func (c *Controller) Run(ctx context.Context) error {
+	defer utilruntime.HandleCrash()
+
+	logger.DefaultLog("Starting the PersistentVolumeMigration controller")
+	go c.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		c.queue.ShutDown()
+		return fmt.Errorf("failed to sync the PersistentVolumeMigration informer")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for c.processNextItem(ctx) {
+		}
+	}()
+	<-ctx.Done()
+	logger.DefaultLog("Stopping the PersistentVolumeMigration controller")
+	c.queue.ShutDown()
+	<-done
+	return nil
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	// no new migration is started once the controller is stopping.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err := c.reconcile(key.(string)); err != nil {
+		logger.ErrorLog("failed to reconcile PersistentVolumeMigration %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile runs the migration of the resource, unless it was already run
+// for the current generation of its spec. The failure of the migration is
+// recorded in the status of the resource and isn't retried until the spec
+// changes; only the failures to update the status are returned.
+func (c *Controller) reconcile(key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	pvm := &PersistentVolumeMigration{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).UnstructuredContent(), pvm)
+	if err != nil {
+		return fmt.Errorf("failed to parse PersistentVolumeMigration %s: %v", key, err)
+	}
+	if pvm.Status.ObservedGeneration == pvm.Generation &&
+		(pvm.Status.Phase == PhaseSucceeded || pvm.Status.Phase == PhaseFailed) {
+		return nil
+	}
+
+	interrupted := pvm.Status.Phase == PhaseRunning
+	s := &statusUpdater{client: c.client, name: pvm.Name, status: pvm.Status}
+	s.status.Phase = PhaseRunning
+	s.status.PVCs = nil
+	meta.SetStatusCondition(&s.status.Conditions, metav1.Condition{
+		Type:               ConditionProgressing,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: pvm.Generation,
+		Reason:             "Migrating",
+		Message:            "the PVCs are being migrated",
+	})
+	if err = s.update(); err != nil {
+		return err
+	}
+
+	logger.DefaultLog("Reconciling PersistentVolumeMigration %s", pvm.Name)
+	opts := c.options(pvm)
+	opts.Progress = s.progress
+	// the migrations of the PVCs which were deleted when the controller
+	// stopped are only found in the journal, which is shared with the other
+	// resources: only the ones of the PVCs selected by this resource are
+	// resumed.
+	if interrupted {
+		err = migration.ResumeMigration(opts)
+	}
+	if err == nil {
+		err = migration.MigrateToCSI(opts)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.ObservedGeneration = pvm.Generation
+	s.status.Phase = PhaseSucceeded
+	ready := metav1.Condition{
+		Type:               ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: pvm.Generation,
+		Reason:             "Migrated",
+		Message:            "all the PVCs were migrated",
+	}
+	if err != nil {
+		logger.ErrorLog("PersistentVolumeMigration %s failed: %v", pvm.Name, err)
+		s.status.Phase = PhaseFailed
+		ready.Status = metav1.ConditionFalse
+		ready.Reason = "MigrationFailed"
+		ready.Message = err.Error()
+	}
+	meta.SetStatusCondition(&s.status.Conditions, ready)
+	meta.SetStatusCondition(&s.status.Conditions, metav1.Condition{
+		Type:               ConditionProgressing,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: pvm.Generation,
+		Reason:             s.status.Phase,
+	})
+	return s.updateLocked()
+}
+
+// options returns the settings of the migration of the resource.
+func (c *Controller) options(pvm *PersistentVolumeMigration) *migration.Options {
+	opts := *c.base
+	spec := pvm.Spec
+	opts.SourceStorageClass = spec.SourceStorageClass
+	opts.DestinationStorageClass = spec.DestinationStorageClass
+	opts.PVCName = ""
+	opts.PVCNamespace = ""
+	opts.DryRun = false
+	opts.ReportFile = ""
+	opts.Filter = k8sutil.PVCFilter{
+		Namespaces:        spec.Selector.Namespaces,
+		NamespaceSelector: spec.Selector.NamespaceSelector,
+		PVCSelector:       spec.Selector.PVCSelector,
+		Exclude:           spec.Selector.Exclude,
+	}
+	opts.ResumeSelected = true
+
+	o := spec.Options
+	overrideBool(&opts.Static, o.Static)
+	overrideBool(&opts.CrossPool, o.CrossPool)
+	overrideBool(&opts.Force, o.Force)
+	overrideBool(&opts.ScaleWorkloads, o.ScaleWorkloads)
+	overrideBool(&opts.ContinueOnError, o.ContinueOnError)
+	if o.Parallelism > 0 {
+		opts.Parallelism = o.Parallelism
+	}
+	if o.PreserveMetadata != nil {
+		opts.MetadataPolicy.Preserve = o.PreserveMetadata
+	}
+	if o.DropAnnotations != nil {
+		opts.MetadataPolicy.DropAnnotations = o.DropAnnotations
+	}
+	if o.TrashDelay != nil {
+		opts.TrashDelay = o.TrashDelay.Duration
+	}
+	return &opts
+}
+
+// overrideBool sets the option to the value of the resource, if it is set.
+func overrideBool(option *bool, value *bool) {
+	if value != nil {
+		*option = *value
+	}
+}
+
+// statusUpdater records the progress of a migration in the status of its
+// resource.
+type statusUpdater struct {
+	client dynamic.Interface
+	name   string
+	// mu serializes the updates of the status by the migration workers.
+	mu     sync.Mutex
+	status PersistentVolumeMigrationStatus
+}
+
+// progress records the progress of the migration of a PVC. The failure to
+// update the status doesn't stop the migration.
+func (s *statusUpdater) progress(p migration.PVCProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pvc := PVCStatus{Namespace: p.Namespace, Name: p.Name, UID: p.UID, Phase: p.Phase, Step: p.Step}
+	if p.Err != nil {
+		pvc.Message = p.Err.Error()
+	}
+	found := false
+	for i := range s.status.PVCs {
+		if s.status.PVCs[i].Namespace == p.Namespace && s.status.PVCs[i].Name == p.Name {
+			s.status.PVCs[i] = pvc
+			found = true
+			break
+		}
+	}
+	if !found {
+		s.status.PVCs = append(s.status.PVCs, pvc)
+	}
+	// the status is only written once all the PVCs were reported pending,
+	// when the first one starts to be migrated.
+	if p.Phase == migration.PVCPending {
+		return
+	}
+	if err := s.updateLocked(); err != nil {
+		logger.ErrorLog("%v", err)
+	}
+}
+
+func (s *statusUpdater) update() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked()
+}
+
+// updateLocked writes the status to the resource. s.mu must be held.
+func (s *statusUpdater) updateLocked() error {
+	s.status.Total = len(s.status.PVCs)
+	s.status.Migrated = 0
+	for _, pvc := range s.status.PVCs {
+		if pvc.Phase == migration.PVCMigrated {
+			s.status.Migrated++
+		}
+	}
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&s.status)
+	if err != nil {
+		return fmt.Errorf("failed to serialize the status of PersistentVolumeMigration %s: %v", s.name, err)
+	}
+
+	client := s.client.Resource(resource)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(context.TODO(), s.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err = unstructured.SetNestedField(obj.Object, status, "status"); err != nil {
+			return err
+		}
+		_, err = client.UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the status of PersistentVolumeMigration %s: %v", s.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// resource is the PersistentVolumeMigration custom resource, defined in
+// manifests/crd.yaml.
+var resource = schema.GroupVersionResource{
+	Group:    "pvmigrator.ceph.io",
+	Version:  "v1alpha1",
+	Resource: "persistentvolumemigrations",
+}
+
+const (
+	// PhaseRunning is the phase of a migration whose PVCs are being
+	// migrated.
+	PhaseRunning = "Running"
+	// PhaseSucceeded is the phase of a migration whose PVCs were all
+	// migrated.
+	PhaseSucceeded = "Succeeded"
+	// PhaseFailed is the phase of a migration which failed to migrate some
+	// of its PVCs.
+	PhaseFailed = "Failed"
+
+	// ConditionReady is true once all the PVCs of the migration were
+	// migrated.
+	ConditionReady = "Ready"
+	// ConditionProgressing is true while the PVCs are being migrated.
+	ConditionProgressing = "Progressing"
+)
+
+// PersistentVolumeMigration declares the migration of the PVCs of a
+// storageclass to a CSI storageclass.
+type PersistentVolumeMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PersistentVolumeMigrationSpec   `json:"spec"`
+	Status PersistentVolumeMigrationStatus `json:"status,omitempty"`
+}
+
+// PersistentVolumeMigrationSpec holds the PVCs to migrate and how.
+type PersistentVolumeMigrationSpec struct {
+	SourceStorageClass      string `json:"sourceStorageClass"`
+	DestinationStorageClass string `json:"destinationStorageClass"`
+	// Selector selects the PVCs of the source storageclass to migrate, all
+	// of them if it is empty.
+	Selector PVCSelector `json:"selector,omitempty"`
+	// Options holds the settings of the migration, the ones of the
+	// controller command line are used for the unset ones.
+	Options MigrationOptions `json:"options,omitempty"`
+}
+
+// PVCSelector selects the PVCs to migrate, like the filter flags of the
+// command line.
+type PVCSelector struct {
+	Namespaces        []string `json:"namespaces,omitempty"`
+	NamespaceSelector string   `json:"namespaceSelector,omitempty"`
+	PVCSelector       string   `json:"pvcSelector,omitempty"`
+	Exclude           []string `json:"exclude,omitempty"`
+}
+
+// MigrationOptions holds the settings of the migration, like the flags of
+// the command line. The booleans are pointers, so that a resource can turn
+// off an option set by the flags.
+type MigrationOptions struct {
+	Static           *bool            `json:"static,omitempty"`
+	CrossPool        *bool            `json:"crossPool,omitempty"`
+	Force            *bool            `json:"force,omitempty"`
+	ScaleWorkloads   *bool            `json:"scaleWorkloads,omitempty"`
+	Parallelism      int              `json:"parallelism,omitempty"`
+	ContinueOnError  *bool            `json:"continueOnError,omitempty"`
+	PreserveMetadata []string         `json:"preserveMetadata,omitempty"`
+	DropAnnotations  []string         `json:"dropAnnotations,omitempty"`
+	TrashDelay       *metav1.Duration `json:"trashDelay,omitempty"`
+}
+
+// PersistentVolumeMigrationStatus is the observed state of the migration.
+type PersistentVolumeMigrationStatus struct {
+	// ObservedGeneration is the generation of the spec the migration was
+	// last completed for.
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Phase              string             `json:"phase,omitempty"`
+	Migrated           int                `json:"migrated"`
+	Total              int                `json:"total"`
+	PVCs               []PVCStatus        `json:"pvcs,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// PVCStatus is the state of the migration of a PVC.
+type PVCStatus struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+	Phase     string `json:"phase"`
+	// Step is the last step of the migration which was completed.
+	Step    string `json:"step,omitempty"`
+	Message string `json:"message,omitempty"`
+}
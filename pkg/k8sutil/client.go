@@ -20,13 +20,16 @@ import (
 	"fmt"
 	"os"
 
+	"k8s.io/client-go/dynamic"
 	k8s "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// NewClient create kubernetes client.
-func NewClient(configPath string) (*k8s.Clientset, error) {
+// NewConfig returns the configuration of the kubernetes client, read from the
+// kubeconfig file at configPath or KUBERNETES_CONFIG_PATH, or from the service
+// account of the pod if none is set.
+func NewConfig(configPath string) (*rest.Config, error) {
 	var cfg *rest.Config
 	var err error
 	if configPath == "" {
@@ -43,9 +46,31 @@ func NewClient(configPath string) (*k8s.Clientset, error) {
 			return nil, fmt.Errorf("Failed to get cluster config with error: %v\n", err)
 		}
 	}
+	return cfg, nil
+}
+
+// NewClient create kubernetes client.
+func NewClient(configPath string) (*k8s.Clientset, error) {
+	cfg, err := NewConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
 	client, err := k8s.NewForConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create client with error: %v\n", err)
 	}
 	return client, nil
 }
+
+// NewDynamicClient creates a kubernetes client for the custom resources.
+func NewDynamicClient(configPath string) (dynamic.Interface, error) {
+	cfg, err := NewConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %v", err)
+	}
+	return client, nil
+}
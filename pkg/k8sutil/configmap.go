@@ -21,29 +21,108 @@ import (
 	"encoding/json"
 	"fmt"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
-type csiClusterConfigEntry struct {
+// CSIClusterConfigEntry is the configuration of a ceph cluster in the CSI
+// configuration.
+type CSIClusterConfigEntry struct {
 	ClusterID string   `json:"clusterID"`
 	Monitors  []string `json:"monitors"`
 }
 
-type csiClusterConfig []csiClusterConfigEntry
+// CSIClusterConfig is the configuration of the ceph clusters of the CSI
+// drivers.
+type CSIClusterConfig []CSIClusterConfigEntry
 
-func GetCSIConfiguration(client *kubernetes.Clientset, namespace string) (csiClusterConfig, error) {
-	var cc csiClusterConfig
+const (
+	// DefaultCSIConfigMap is the ConfigMap of the CSI configuration created
+	// by Rook.
+	DefaultCSIConfigMap = "rook-ceph-csi-config"
+	// DefaultCSIConfigKey is the key of the CSI configuration in the
+	// ConfigMap created by Rook.
+	DefaultCSIConfigKey = "csi-cluster-config-json"
+)
+
+// GetCSIConfiguration returns the CSI configuration stored under the key of
+// the ConfigMap, the ones created by Rook if they are empty.
+func GetCSIConfiguration(client *kubernetes.Clientset, namespace, name, key string) (CSIClusterConfig, error) {
+	var cc CSIClusterConfig
 	getOpt := v1.GetOptions{}
 	ctx := context.TODO()
-	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, "rook-ceph-csi-config", getOpt)
+	if name == "" {
+		name = DefaultCSIConfigMap
+	}
+	if key == "" {
+		key = DefaultCSIConfigKey
+	}
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, getOpt)
 	if err != nil {
 		return nil, err
 	}
-	c := cm.Data["csi-cluster-config-json"]
+	c, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %s is missing in configmap %s/%s", key, namespace, name)
+	}
 	err = json.Unmarshal([]byte(c), &cc)
 	if err != nil {
 		return cc, fmt.Errorf("failed to parse csi cluster config %w", err)
 	}
 	return cc, nil
 }
+
+func GetConfigMap(client *kubernetes.Clientset, namespace, name string) (*corev1.ConfigMap, error) {
+	return client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, v1.GetOptions{})
+}
+
+// GetOrCreateConfigMap returns the ConfigMap with the given name, creating an
+// empty one if it doesn't exist yet.
+func GetOrCreateConfigMap(client *kubernetes.Clientset, namespace, name string) (*corev1.ConfigMap, error) {
+	ctx := context.TODO()
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, v1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	if !apierrs.IsNotFound(err) {
+		return nil, err
+	}
+	cm = &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	return client.CoreV1().ConfigMaps(namespace).Create(ctx, cm, v1.CreateOptions{})
+}
+
+func CreateConfigMap(client *kubernetes.Clientset, cm *corev1.ConfigMap) error {
+	_, err := client.CoreV1().ConfigMaps(cm.Namespace).Create(context.TODO(), cm, v1.CreateOptions{})
+	return err
+}
+
+// ListConfigMaps returns the ConfigMaps of the namespace matching the label
+// selector.
+func ListConfigMaps(client *kubernetes.Clientset, namespace, selector string) ([]corev1.ConfigMap, error) {
+	list, err := client.CoreV1().ConfigMaps(namespace).List(context.TODO(), v1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// DeleteConfigMap deletes the ConfigMap, it doesn't fail if it doesn't exist.
+func DeleteConfigMap(client *kubernetes.Clientset, namespace, name string) error {
+	err := client.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), name, v1.DeleteOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func UpdateConfigMap(client *kubernetes.Clientset, cm *corev1.ConfigMap) error {
+	_, err := client.CoreV1().ConfigMaps(cm.Namespace).Update(context.TODO(), cm, v1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PreserveLabels keeps the labels of the PVC.
+	PreserveLabels = "labels"
+	// PreserveAnnotations keeps the annotations of the PVC, except the ones
+	// set by Kubernetes for its binding and provisioning.
+	PreserveAnnotations = "annotations"
+	// PreserveFinalizers keeps the finalizers of the PVC.
+	PreserveFinalizers = "finalizers"
+	// PreserveOwnerReferences keeps the owner references of the PVC.
+	PreserveOwnerReferences = "owner-references"
+)
+
+// systemAnnotationPrefixes are the prefixes of the annotations set by
+// Kubernetes for the binding and the provisioning of a PVC, which describe the
+// original PVC and are never carried over.
+var systemAnnotationPrefixes = []string{
+	"pv.kubernetes.io/",
+	"volume.beta.kubernetes.io/",
+	"volume.kubernetes.io/",
+}
+
+// PreserveOptions returns the kinds of metadata a MetadataPolicy can preserve.
+func PreserveOptions() []string {
+	return []string{PreserveLabels, PreserveAnnotations, PreserveFinalizers, PreserveOwnerReferences}
+}
+
+// MetadataPolicy selects the metadata of the original PVC which is carried
+// over to the PVC created in the destination storageclass.
+type MetadataPolicy struct {
+	// Preserve holds the kinds of metadata which are kept.
+	Preserve []string
+	// DropAnnotations holds the prefixes of the annotations which are
+	// dropped in addition to the ones set by Kubernetes.
+	DropAnnotations []string
+}
+
+// Validate checks the kinds of metadata to preserve.
+func (p *MetadataPolicy) Validate() error {
+	for _, kind := range p.Preserve {
+		if !p.valid(kind) {
+			return fmt.Errorf("unsupported metadata %q to preserve, supported: %v", kind, PreserveOptions())
+		}
+	}
+	return nil
+}
+
+func (p *MetadataPolicy) valid(kind string) bool {
+	for _, k := range PreserveOptions() {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *MetadataPolicy) preserves(kind string) bool {
+	for _, k := range p.Preserve {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply removes from the metadata what the policy doesn't preserve.
+func (p *MetadataPolicy) Apply(meta *v1.ObjectMeta) {
+	if !p.preserves(PreserveLabels) {
+		meta.Labels = nil
+	}
+	annotations := map[string]string{}
+	if p.preserves(PreserveAnnotations) {
+		for key, value := range meta.Annotations {
+			if !p.dropsAnnotation(key) {
+				annotations[key] = value
+			}
+		}
+	}
+	meta.Annotations = annotations
+	if !p.preserves(PreserveFinalizers) {
+		meta.Finalizers = nil
+	}
+	if !p.preserves(PreserveOwnerReferences) {
+		meta.OwnerReferences = nil
+	}
+}
+
+func (p *MetadataPolicy) dropsAnnotation(key string) bool {
+	if isSystemAnnotation(key) {
+		return true
+	}
+	for _, prefix := range p.DropAnnotations {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSystemAnnotation(key string) bool {
+	for _, prefix := range systemAnnotationPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetadataChanges lists the labels, annotations, finalizers and owner
+// references which differ between the old and the new metadata, as
+// "<kind> <key> added|removed|changed". The annotations set by Kubernetes
+// are left out, as they are never carried over.
+func MetadataChanges(old, new *v1.ObjectMeta) []string {
+	var changes []string
+	changes = append(changes, mapChanges("label", old.Labels, new.Labels)...)
+	changes = append(changes, mapChanges("annotation", userAnnotations(old.Annotations), userAnnotations(new.Annotations))...)
+	changes = append(changes, listChanges("finalizer", old.Finalizers, new.Finalizers)...)
+	changes = append(changes, listChanges("ownerReference", ownerReferences(old.OwnerReferences), ownerReferences(new.OwnerReferences))...)
+	return changes
+}
+
+func userAnnotations(annotations map[string]string) map[string]string {
+	user := map[string]string{}
+	for key, value := range annotations {
+		if !isSystemAnnotation(key) {
+			user[key] = value
+		}
+	}
+	return user
+}
+
+func ownerReferences(refs []v1.OwnerReference) []string {
+	names := []string{}
+	for _, ref := range refs {
+		names = append(names, ref.Kind+"/"+ref.Name)
+	}
+	return names
+}
+
+func mapChanges(kind string, old, new map[string]string) []string {
+	var changes []string
+	for key, value := range old {
+		newValue, ok := new[key]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, key))
+		case newValue != value:
+			changes = append(changes, fmt.Sprintf("%s %s changed", kind, key))
+		}
+	}
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, key))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func listChanges(kind string, old, new []string) []string {
+	oldSet, newSet := map[string]string{}, map[string]string{}
+	for _, item := range old {
+		oldSet[item] = item
+	}
+	for _, item := range new {
+		newSet[item] = item
+	}
+	return mapChanges(kind, oldSet, newSet)
+}
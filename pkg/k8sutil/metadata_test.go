@@ -0,0 +1,196 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pvcMetadata returns the metadata of a PVC bound and provisioned by
+// Kubernetes, with metadata of every kind.
+func pvcMetadata() *v1.ObjectMeta {
+	return &v1.ObjectMeta{
+		Labels: map[string]string{"app": "db"},
+		Annotations: map[string]string{
+			"pv.kubernetes.io/bind-completed":               "yes",
+			"volume.beta.kubernetes.io/storage-provisioner": "ceph.rook.io/block",
+			"backup.example.com/schedule":                   "daily",
+			"team":                                          "a",
+		},
+		Finalizers:      []string{"kubernetes.io/pvc-protection"},
+		OwnerReferences: []v1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+	}
+}
+
+func TestMetadataPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		preserve []string
+		wantErr  bool
+	}{
+		{name: "nothing", preserve: nil},
+		{name: "everything", preserve: PreserveOptions()},
+		{name: "unsupported", preserve: []string{PreserveLabels, "status"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &MetadataPolicy{Preserve: tt.preserve}
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetadataPolicyApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy MetadataPolicy
+		want   *v1.ObjectMeta
+	}{
+		{
+			name:   "nothing preserved",
+			policy: MetadataPolicy{},
+			want:   &v1.ObjectMeta{Annotations: map[string]string{}},
+		},
+		{
+			name:   "labels",
+			policy: MetadataPolicy{Preserve: []string{PreserveLabels}},
+			want: &v1.ObjectMeta{
+				Labels:      map[string]string{"app": "db"},
+				Annotations: map[string]string{},
+			},
+		},
+		{
+			name:   "annotations without the system ones",
+			policy: MetadataPolicy{Preserve: []string{PreserveAnnotations}},
+			want: &v1.ObjectMeta{
+				Annotations: map[string]string{"backup.example.com/schedule": "daily", "team": "a"},
+			},
+		},
+		{
+			name:   "annotations with dropped prefixes",
+			policy: MetadataPolicy{Preserve: []string{PreserveAnnotations}, DropAnnotations: []string{"backup.example.com/"}},
+			want: &v1.ObjectMeta{
+				Annotations: map[string]string{"team": "a"},
+			},
+		},
+		{
+			name:   "finalizers and owner references",
+			policy: MetadataPolicy{Preserve: []string{PreserveFinalizers, PreserveOwnerReferences}},
+			want: &v1.ObjectMeta{
+				Annotations:     map[string]string{},
+				Finalizers:      []string{"kubernetes.io/pvc-protection"},
+				OwnerReferences: []v1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+			},
+		},
+		{
+			name:   "everything",
+			policy: MetadataPolicy{Preserve: PreserveOptions()},
+			want: &v1.ObjectMeta{
+				Labels:          map[string]string{"app": "db"},
+				Annotations:     map[string]string{"backup.example.com/schedule": "daily", "team": "a"},
+				Finalizers:      []string{"kubernetes.io/pvc-protection"},
+				OwnerReferences: []v1.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := pvcMetadata()
+			tt.policy.Apply(meta)
+			if !reflect.DeepEqual(meta, tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", meta, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(meta *v1.ObjectMeta)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			update: func(meta *v1.ObjectMeta) {},
+			want:   nil,
+		},
+		{
+			name: "system annotations are ignored",
+			update: func(meta *v1.ObjectMeta) {
+				delete(meta.Annotations, "pv.kubernetes.io/bind-completed")
+				meta.Annotations["volume.kubernetes.io/selected-node"] = "node-1"
+			},
+			want: nil,
+		},
+		{
+			name: "labels",
+			update: func(meta *v1.ObjectMeta) {
+				meta.Labels = map[string]string{"app": "web", "tier": "front"}
+			},
+			want: []string{"label app changed", "label tier added"},
+		},
+		{
+			name: "annotations",
+			update: func(meta *v1.ObjectMeta) {
+				delete(meta.Annotations, "team")
+				meta.Annotations["backup.example.com/schedule"] = "weekly"
+			},
+			want: []string{"annotation backup.example.com/schedule changed", "annotation team removed"},
+		},
+		{
+			name: "finalizers and owner references",
+			update: func(meta *v1.ObjectMeta) {
+				meta.Finalizers = []string{"example.com/protect"}
+				meta.OwnerReferences = nil
+			},
+			want: []string{
+				"finalizer example.com/protect added",
+				"finalizer kubernetes.io/pvc-protection removed",
+				"ownerReference StatefulSet/db removed",
+			},
+		},
+		{
+			name: "nothing preserved",
+			update: func(meta *v1.ObjectMeta) {
+				(&MetadataPolicy{}).Apply(meta)
+			},
+			want: []string{
+				"label app removed",
+				"annotation backup.example.com/schedule removed",
+				"annotation team removed",
+				"finalizer kubernetes.io/pvc-protection removed",
+				"ownerReference StatefulSet/db removed",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := pvcMetadata()
+			tt.update(meta)
+			got := MetadataChanges(pvcMetadata(), meta)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MetadataChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// ListPodsUsingPVC returns the pods, which haven't terminated, that mount the
+// PVC.
+func ListPodsUsingPVC(client *k8s.Clientset, pvc *corev1.PersistentVolumeClaim) ([]corev1.Pod, error) {
+	pods, err := ListRunningPods(client, pvc.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	var using []corev1.Pod
+	for _, pod := range pods {
+		if PodUsesPVC(&pod, pvc.Name) { // nolint:gosec // skip gosec as pod is not retained.
+			using = append(using, pod)
+		}
+	}
+	return using, nil
+}
+
+// ListRunningPods returns the pods of the namespace, or of all the namespaces
+// if it is empty, which haven't terminated.
+func ListRunningPods(client *k8s.Clientset, namespace string) ([]corev1.Pod, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var running []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		running = append(running, pod)
+	}
+	return running, nil
+}
+
+// PodUsesPVC returns true if the pod mounts the PVC with the given name.
+func PodUsesPVC(pod *corev1.Pod, pvcName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+			return true
+		}
+	}
+	return false
+}
+
+// ListVolumeAttachments returns the VolumeAttachments of the PV.
+func ListVolumeAttachments(client *k8s.Clientset, pvName string) ([]storagev1.VolumeAttachment, error) {
+	attachments, err := client.StorageV1().VolumeAttachments().List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var found []storagev1.VolumeAttachment
+	for _, va := range attachments.Items {
+		if va.Spec.Source.PersistentVolumeName != nil && *va.Spec.Source.PersistentVolumeName == pvName {
+			found = append(found, va)
+		}
+	}
+	return found, nil
+}
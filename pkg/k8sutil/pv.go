@@ -19,11 +19,13 @@ package k8sutil
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	logger "persistent-volume-migrator/pkg/log"
 
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -43,20 +45,34 @@ func GetPV(client *k8s.Clientset, pvName string) (*corev1.PersistentVolume, erro
 	return pv, nil
 }
 
+// ListPVs returns all the PVs of the cluster.
+func ListPVs(client *k8s.Clientset) ([]corev1.PersistentVolume, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pvs.Items, nil
+}
+
 func DeletePV(client *k8s.Clientset, pv *corev1.PersistentVolume) error {
 	err := client.CoreV1().PersistentVolumes().Delete(context.TODO(), pv.Name, v1.DeleteOptions{})
 	if err != nil {
 		return err
 	}
 
-	timeout := time.Duration(1) * time.Minute
+	return WaitForPVDeletion(client, pv, time.Duration(1)*time.Minute)
+}
+
+// WaitForPVDeletion waits for the PV to be removed from the cluster.
+func WaitForPVDeletion(client *k8s.Clientset, pv *corev1.PersistentVolume, timeout time.Duration) error {
+	var err error
 	start := time.Now()
 	pvToDelete := pv
 	return wait.PollImmediate(poll, timeout, func() (bool, error) {
 		// Check that the PV is deleted.
 		logger.DefaultLog("waiting for PV %s in state %s to be deleted (%d seconds elapsed) \n", pvToDelete.Name, pvToDelete.Status.String(), int(time.Since(start).Seconds()))
 
-		pvToDelete, err = client.CoreV1().PersistentVolumes().Get(context.TODO(), pvToDelete.Name, v1.GetOptions{})
+		pvToDelete, err = client.CoreV1().PersistentVolumes().Get(context.TODO(), pv.Name, v1.GetOptions{})
 		if err == nil {
 			return false, nil
 		}
@@ -69,6 +85,15 @@ func DeletePV(client *k8s.Clientset, pv *corev1.PersistentVolume) error {
 	})
 }
 
+func CreatePV(client *k8s.Clientset, pv *corev1.PersistentVolume) (*corev1.PersistentVolume, error) {
+	return client.CoreV1().PersistentVolumes().Create(context.TODO(), pv, v1.CreateOptions{})
+}
+
+func UpdatePV(client *k8s.Clientset, pv *corev1.PersistentVolume) error {
+	_, err := client.CoreV1().PersistentVolumes().Update(context.TODO(), pv, v1.UpdateOptions{})
+	return err
+}
+
 func UpdateReclaimPolicy(client *k8s.Clientset, pv *corev1.PersistentVolume) error {
 	pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
 	updateOpt := v1.UpdateOptions{}
@@ -97,6 +122,203 @@ func GetVolumeName(pv *corev1.PersistentVolume) string {
 	return ""
 }
 
+// GetVolumePool returns the pool of the rbd image backing the PV, or an empty
+// string if the PV doesn't record it.
+func GetVolumePool(pv *corev1.PersistentVolume) string {
+	if pv.Spec.FlexVolume != nil {
+		// Rook flex driver stores the pool either as pool or blockPool option.
+		if pool := pv.Spec.FlexVolume.Options["pool"]; pool != "" {
+			return pool
+		}
+		return pv.Spec.FlexVolume.Options["blockPool"]
+	}
+	if pv.Spec.RBD != nil {
+		return pv.Spec.RBD.RBDPool
+	}
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.VolumeAttributes["pool"]
+	}
+	return ""
+}
+
+// GetFlexClusterNamespace returns the namespace of the Rook cluster of a flex
+// volume, which Rook uses as the clusterID of its CSI drivers, or an empty
+// string if the PV isn't a flex volume.
+func GetFlexClusterNamespace(pv *corev1.PersistentVolume) string {
+	if pv.Spec.FlexVolume == nil {
+		return ""
+	}
+	return pv.Spec.FlexVolume.Options["clusterNamespace"]
+}
+
+// GetVolumeFSType returns the filesystem type of the PV.
+func GetVolumeFSType(pv *corev1.PersistentVolume) string {
+	if pv.Spec.FlexVolume != nil {
+		return pv.Spec.FlexVolume.FSType
+	}
+	if pv.Spec.RBD != nil {
+		return pv.Spec.RBD.FSType
+	}
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.FSType
+	}
+	return ""
+}
+
+// IsFlexVolume returns true if the PV is provisioned by the Rook flex driver,
+// named ceph.rook.io/<rook-namespace>.
+func IsFlexVolume(pv *corev1.PersistentVolume) bool {
+	return pv.Spec.FlexVolume != nil && strings.HasPrefix(pv.Spec.FlexVolume.Driver, "ceph.rook.io/")
+}
+
+// IsCephFSVolume returns true if the PV is a CephFS share, provisioned either
+// by the in-tree cephfs driver or by the Rook flex driver.
+func IsCephFSVolume(pv *corev1.PersistentVolume) bool {
+	if pv.Spec.CephFS != nil {
+		return true
+	}
+	// Rook flex driver sets the file system name only for CephFS shares.
+	return pv.Spec.FlexVolume != nil && pv.Spec.FlexVolume.Options["fsName"] != ""
+}
+
+// GetCephFSPath returns the path of the CephFS share within the file system.
+func GetCephFSPath(pv *corev1.PersistentVolume) string {
+	path := ""
+	if pv.Spec.CephFS != nil {
+		path = pv.Spec.CephFS.Path
+	} else if pv.Spec.FlexVolume != nil {
+		path = pv.Spec.FlexVolume.Options["path"]
+	}
+	// both drivers mount the root of the file system by default.
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// GetCephFSName returns the name of the file system of the CephFS share, or an
+// empty string if the PV doesn't record it, as with the in-tree driver.
+func GetCephFSName(pv *corev1.PersistentVolume) string {
+	if pv.Spec.FlexVolume != nil {
+		return pv.Spec.FlexVolume.Options["fsName"]
+	}
+	return ""
+}
+
+// GenerateStaticCephFSPV generates a pre-provisioned CephFS CSI PV, with the
+// same name as the given PV, which mounts the existing path of the file
+// system. The PV is reserved for the PVC the given PV was bound to.
+func GenerateStaticCephFSPV(sc *storagev1.StorageClass, pv *corev1.PersistentVolume, clusterID, fsName, rootPath string) *corev1.PersistentVolume {
+	staticPV := &corev1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			AccessModes: pv.Spec.AccessModes,
+			Capacity:    pv.Spec.Capacity,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       sc.Provisioner,
+					VolumeHandle: pv.Name,
+					VolumeAttributes: map[string]string{
+						"clusterID":    clusterID,
+						"fsName":       fsName,
+						"rootPath":     rootPath,
+						"staticVolume": "true",
+					},
+					NodeStageSecretRef: secretReference(sc, "node-stage"),
+				},
+			},
+			// the share is not managed by the CSI provisioner, it must never
+			// be deleted along with the PV.
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              sc.Name,
+			MountOptions:                  sc.MountOptions,
+			VolumeMode:                    pv.Spec.VolumeMode,
+			NodeAffinity:                  pv.Spec.NodeAffinity,
+		},
+	}
+	if pv.Spec.ClaimRef != nil {
+		staticPV.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:       pv.Spec.ClaimRef.Kind,
+			APIVersion: pv.Spec.ClaimRef.APIVersion,
+			Namespace:  pv.Spec.ClaimRef.Namespace,
+			Name:       pv.Spec.ClaimRef.Name,
+		}
+	}
+	return staticPV
+}
+
+// GenerateStaticCSIPV generates a pre-provisioned CSI PV, with the same name as
+// the given PV, which points to the existing rbd image in the given pool. The
+// PV is reserved for the PVC the given PV was bound to.
+func GenerateStaticCSIPV(sc *storagev1.StorageClass, pv *corev1.PersistentVolume, pool, clusterID, imageName string) *corev1.PersistentVolume {
+	fsType := GetVolumeFSType(pv)
+	if fsType == "" && (pv.Spec.VolumeMode == nil || *pv.Spec.VolumeMode == corev1.PersistentVolumeFilesystem) {
+		fsType = sc.Parameters[csiParameterPrefix+"fstype"]
+	}
+	staticPV := &corev1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			AccessModes: pv.Spec.AccessModes,
+			Capacity:    pv.Spec.Capacity,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       sc.Provisioner,
+					VolumeHandle: imageName,
+					FSType:       fsType,
+					VolumeAttributes: map[string]string{
+						"clusterID":    clusterID,
+						"pool":         pool,
+						"imageName":    imageName,
+						"staticVolume": "true",
+					},
+					NodeStageSecretRef:        secretReference(sc, "node-stage"),
+					ControllerExpandSecretRef: secretReference(sc, "controller-expand"),
+				},
+			},
+			// the image is not managed by the CSI provisioner, it must never
+			// be deleted along with the PV.
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			StorageClassName:              sc.Name,
+			MountOptions:                  sc.MountOptions,
+			VolumeMode:                    pv.Spec.VolumeMode,
+			NodeAffinity:                  pv.Spec.NodeAffinity,
+		},
+	}
+	if features := GetStorageClassImageFeatures(sc); len(features) > 0 {
+		staticPV.Spec.CSI.VolumeAttributes["imageFeatures"] = strings.Join(features, ",")
+	}
+	if pv.Spec.ClaimRef != nil {
+		staticPV.Spec.ClaimRef = &corev1.ObjectReference{
+			Kind:       pv.Spec.ClaimRef.Kind,
+			APIVersion: pv.Spec.ClaimRef.APIVersion,
+			Namespace:  pv.Spec.ClaimRef.Namespace,
+			Name:       pv.Spec.ClaimRef.Name,
+		}
+	}
+	return staticPV
+}
+
+// secretReference returns the secret set for the given CSI operation in the
+// storageclass parameters.
+func secretReference(sc *storagev1.StorageClass, operation string) *corev1.SecretReference {
+	name := sc.Parameters[csiParameterPrefix+operation+"-secret-name"]
+	if name == "" {
+		return nil
+	}
+	return &corev1.SecretReference{
+		Name:      name,
+		Namespace: sc.Parameters[csiParameterPrefix+operation+"-secret-namespace"],
+	}
+}
+
 func WaitForRBDImage(pv *corev1.PersistentVolume) string {
 	retry := 0
 	maxRetry := 15
@@ -119,6 +341,11 @@ func GetCSIPoolName(pv *corev1.PersistentVolume) string {
 	return pv.Spec.CSI.VolumeAttributes["pool"]
 }
 
+// GetCSIImageName returns the name of the rbd image of a CSI PV.
+func GetCSIImageName(pv *corev1.PersistentVolume) string {
+	return pv.Spec.CSI.VolumeAttributes["imageName"]
+}
+
 func GetClusterID(pv *corev1.PersistentVolume) string {
 	// clusterID which denotes the cluster namespace where image is created
 	return pv.Spec.CSI.VolumeAttributes["clusterID"]
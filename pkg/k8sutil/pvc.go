@@ -19,6 +19,8 @@ package k8sutil
 import (
 	"context"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	logger "persistent-volume-migrator/pkg/log"
@@ -26,6 +28,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	k8s "k8s.io/client-go/kubernetes"
@@ -35,29 +38,113 @@ const (
 	storageClassBetaAnnotationKey = "volume.beta.kubernetes.io/storage-class"
 )
 
-func ListAllPVCWithStorageclass(client *k8s.Clientset, scName string) (*[]corev1.PersistentVolumeClaim, error) {
+// PVCFilter narrows down the PVCs listed by ListAllPVCWithStorageclass. The
+// zero value selects every PVC.
+type PVCFilter struct {
+	// Namespaces restricts the PVCs to these namespaces.
+	Namespaces []string
+	// NamespaceSelector is a label selector restricting the namespaces.
+	NamespaceSelector string
+	// PVCSelector is a label selector restricting the PVCs.
+	PVCSelector string
+	// Exclude holds namespace/name patterns, as accepted by path.Match, of
+	// the PVCs to leave out. A pattern without a slash matches the PVC name
+	// in every namespace.
+	Exclude []string
+}
+
+// Validate checks the selectors and the exclusion patterns of the filter.
+func (f *PVCFilter) Validate() error {
+	if _, err := labels.Parse(f.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespace selector %q: %v", f.NamespaceSelector, err)
+	}
+	if _, err := labels.Parse(f.PVCSelector); err != nil {
+		return fmt.Errorf("invalid PVC selector %q: %v", f.PVCSelector, err)
+	}
+	for _, pattern := range f.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns true if the PVC matches any of the exclusion patterns.
+func (f *PVCFilter) excluded(namespace, name string) bool {
+	for _, pattern := range f.Exclude {
+		value := name
+		if strings.Contains(pattern, "/") {
+			value = namespace + "/" + name
+		}
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the PVC is selected by the filter, nsLabels being
+// the labels of the namespace of the PVC.
+func (f *PVCFilter) Matches(pvc *corev1.PersistentVolumeClaim, nsLabels map[string]string) (bool, error) {
+	if len(f.Namespaces) > 0 && !containsString(f.Namespaces, pvc.Namespace) {
+		return false, nil
+	}
+	nsSelector, err := labels.Parse(f.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid namespace selector %q: %v", f.NamespaceSelector, err)
+	}
+	pvcSelector, err := labels.Parse(f.PVCSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid PVC selector %q: %v", f.PVCSelector, err)
+	}
+	return nsSelector.Matches(labels.Set(nsLabels)) && pvcSelector.Matches(labels.Set(pvc.Labels)) &&
+		!f.excluded(pvc.Namespace, pvc.Name), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNamespaceLabels returns the labels of the namespace.
+func GetNamespaceLabels(client *k8s.Clientset, name string) (map[string]string, error) {
+	ns, err := client.CoreV1().Namespaces().Get(context.TODO(), name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return ns.Labels, nil
+}
+
+func ListAllPVCWithStorageclass(client *k8s.Clientset, scName string, filter *PVCFilter) (*[]corev1.PersistentVolumeClaim, error) {
 	pl := &[]corev1.PersistentVolumeClaim{}
-	listOpt := v1.ListOptions{}
+	if filter == nil {
+		filter = &PVCFilter{}
+	}
 	ctx := context.TODO()
-	ns, err := client.CoreV1().Namespaces().List(ctx, listOpt)
+	ns, err := client.CoreV1().Namespaces().List(ctx, v1.ListOptions{LabelSelector: filter.NamespaceSelector})
 	if err != nil {
 		return nil, err
 	}
+	selected := map[string]bool{}
+	for _, n := range filter.Namespaces {
+		selected[n] = true
+	}
+	listOpt := v1.ListOptions{LabelSelector: filter.PVCSelector}
 	for _, n := range ns.Items {
+		if len(selected) > 0 && !selected[n.Name] {
+			continue
+		}
 		pvc, err := client.CoreV1().PersistentVolumeClaims(n.Name).List(ctx, listOpt)
 		if err != nil {
 			continue
 		}
 		for _, p := range pvc.Items {
-			sc := p.Spec.StorageClassName
-			if sc == nil {
-				if val, ok := p.Annotations[storageClassBetaAnnotationKey]; !ok {
-					continue
-				} else {
-					sc = &val
-				}
-			}
-			if *sc == scName {
+			sc := GetStorageClassName(&p) // nolint:gosec // skip gosec as p is not retained.
+			if sc != "" && sc == scName && !filter.excluded(p.Namespace, p.Name) {
 				*pl = append(*pl, p)
 			}
 		}
@@ -65,6 +152,15 @@ func ListAllPVCWithStorageclass(client *k8s.Clientset, scName string) (*[]corev1
 	return pl, nil
 }
 
+// GetStorageClassName returns the storageclass of the PVC, falling back to
+// the deprecated beta annotation.
+func GetStorageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName
+	}
+	return pvc.Annotations[storageClassBetaAnnotationKey]
+}
+
 func ListSinglePVCWithStorageclass(client *k8s.Clientset, pvcName, pvcNamespace string) (*[]corev1.PersistentVolumeClaim, error) {
 	pl := &[]corev1.PersistentVolumeClaim{}
 
@@ -110,27 +206,51 @@ func DeletePVC(client *k8s.Clientset, pvc *corev1.PersistentVolumeClaim) error {
 	})
 }
 
-func GenerateCSIPVC(storageclass string, pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
-	// csiPVC := &corev1.PersistentVolumeClaim{}
+// GenerateCSIPVC returns a copy of the PVC in the given storageclass, keeping
+// the metadata preserved by the policy.
+func GenerateCSIPVC(storageclass string, pvc *corev1.PersistentVolumeClaim, policy *MetadataPolicy) *corev1.PersistentVolumeClaim {
 	csiPVC := pvc.DeepCopy()
-	csiPVC.ResourceVersion = ""
+	csiPVC.ObjectMeta = v1.ObjectMeta{
+		Name:            pvc.Name,
+		Namespace:       pvc.Namespace,
+		Labels:          csiPVC.Labels,
+		Annotations:     csiPVC.Annotations,
+		Finalizers:      csiPVC.Finalizers,
+		OwnerReferences: csiPVC.OwnerReferences,
+	}
+	policy.Apply(&csiPVC.ObjectMeta)
 	csiPVC.Spec.VolumeName = ""
-	csiPVC.ObjectMeta.Annotations = make(map[string]string)
 	csiPVC.Status = corev1.PersistentVolumeClaimStatus{}
 	csiPVC.Spec.StorageClassName = &storageclass
 
 	return csiPVC
 }
 
+func GetPVC(client *k8s.Clientset, pvcName, pvcNamespace string) (*corev1.PersistentVolumeClaim, error) {
+	return client.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(context.TODO(), pvcName, v1.GetOptions{})
+}
+
+func UpdatePVC(client *k8s.Clientset, pvc *corev1.PersistentVolumeClaim) error {
+	_, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(context.TODO(), pvc, v1.UpdateOptions{})
+	return err
+}
+
 func CreatePVC(c *k8s.Clientset, pvc *corev1.PersistentVolumeClaim, t int) (*corev1.PersistentVolume, error) {
-	timeout := time.Duration(t) * time.Minute
-	pv := &corev1.PersistentVolume{}
-	var err error
-	_, err = c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(context.TODO(), pvc, v1.CreateOptions{})
+	_, err := c.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(context.TODO(), pvc, v1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	return WaitForBoundPV(c, pvc, t)
+}
+
+// WaitForBoundPV waits for an already created PVC to be bound and returns the
+// PV it is bound to.
+func WaitForBoundPV(c *k8s.Clientset, pvc *corev1.PersistentVolumeClaim, t int) (*corev1.PersistentVolume, error) {
+	timeout := time.Duration(t) * time.Minute
+	pv := &corev1.PersistentVolume{}
+	var err error
+
 	name := pvc.Name
 	start := time.Now()
 	logger.DefaultLog("Waiting up to %v to be in Bound state\n", pvc)
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPVCFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  PVCFilter
+		wantErr bool
+	}{
+		{name: "empty", filter: PVCFilter{}},
+		{name: "valid", filter: PVCFilter{NamespaceSelector: "team=a", PVCSelector: "app in (db,web)", Exclude: []string{"ns/*", "tmp-?"}}},
+		{name: "invalid namespace selector", filter: PVCFilter{NamespaceSelector: "=a"}, wantErr: true},
+		{name: "invalid PVC selector", filter: PVCFilter{PVCSelector: "app in (db"}, wantErr: true},
+		{name: "invalid exclude pattern", filter: PVCFilter{Exclude: []string{"ns/[a-"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPVCFilterExcluded(t *testing.T) {
+	tests := []struct {
+		name      string
+		exclude   []string
+		namespace string
+		pvc       string
+		want      bool
+	}{
+		{name: "no pattern", namespace: "ns", pvc: "data", want: false},
+		{name: "name in every namespace", exclude: []string{"data"}, namespace: "other", pvc: "data", want: true},
+		{name: "name glob", exclude: []string{"data-*"}, namespace: "ns", pvc: "data-0", want: true},
+		{name: "namespace and name", exclude: []string{"ns/data"}, namespace: "ns", pvc: "data", want: true},
+		{name: "other namespace", exclude: []string{"ns/data"}, namespace: "other", pvc: "data", want: false},
+		{name: "whole namespace", exclude: []string{"ns/*"}, namespace: "ns", pvc: "logs", want: true},
+		{name: "any name", exclude: []string{"*"}, namespace: "ns", pvc: "data", want: true},
+		{name: "no match", exclude: []string{"logs", "tmp/*"}, namespace: "ns", pvc: "data", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &PVCFilter{Exclude: tt.exclude}
+			if got := f.excluded(tt.namespace, tt.pvc); got != tt.want {
+				t.Errorf("excluded(%q, %q) = %v, want %v", tt.namespace, tt.pvc, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPVCFilterMatches(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Namespace: "ns", Name: "data", Labels: map[string]string{"app": "db"}},
+	}
+	nsLabels := map[string]string{"team": "a"}
+	tests := []struct {
+		name    string
+		filter  PVCFilter
+		want    bool
+		wantErr bool
+	}{
+		{name: "empty filter", filter: PVCFilter{}, want: true},
+		{name: "namespace listed", filter: PVCFilter{Namespaces: []string{"other", "ns"}}, want: true},
+		{name: "namespace not listed", filter: PVCFilter{Namespaces: []string{"other"}}, want: false},
+		{name: "namespace selector", filter: PVCFilter{NamespaceSelector: "team=a"}, want: true},
+		{name: "namespace selector mismatch", filter: PVCFilter{NamespaceSelector: "team=b"}, want: false},
+		{name: "PVC selector", filter: PVCFilter{PVCSelector: "app in (db,web)"}, want: true},
+		{name: "PVC selector mismatch", filter: PVCFilter{PVCSelector: "app!=db"}, want: false},
+		{name: "excluded", filter: PVCFilter{PVCSelector: "app=db", Exclude: []string{"ns/data"}}, want: false},
+		{name: "invalid selector", filter: PVCFilter{PVCSelector: "app in (db"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.filter.Matches(pvc, nsLabels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Matches() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
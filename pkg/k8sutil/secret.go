@@ -19,13 +19,26 @@ package k8sutil
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
-func GetRBDUserAndKeyFromSecret(client *kubernetes.Clientset, namespace string) (string, string, error) {
-	name := "rook-csi-rbd-provisioner"
+const (
+	// DefaultRBDProvisionerSecret is the secret of the rbd CSI provisioner
+	// created by Rook.
+	DefaultRBDProvisionerSecret = "rook-csi-rbd-provisioner"
+	// DefaultCephFSProvisionerSecret is the secret of the CephFS CSI
+	// provisioner created by Rook.
+	DefaultCephFSProvisionerSecret = "rook-csi-cephfs-provisioner"
+	// AdminSecret is the secret of the ceph admin created by Rook.
+	AdminSecret = "rook-ceph-mon"
+)
+
+// GetRBDUserAndKeyFromSecret returns the credentials of the rbd CSI
+// provisioner stored in the given secret.
+func GetRBDUserAndKeyFromSecret(client *kubernetes.Clientset, namespace, name string) (string, string, error) {
 	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, v1.GetOptions{})
 	if err != nil {
 		return "", "", err
@@ -43,3 +56,38 @@ func GetRBDUserAndKeyFromSecret(client *kubernetes.Clientset, namespace string)
 	key := string(secret.Data["userKey"])
 	return user, key, nil
 }
+
+// GetCephFSUserAndKeyFromSecret returns the credentials of the CephFS CSI
+// provisioner stored in the given secret.
+func GetCephFSUserAndKeyFromSecret(client *kubernetes.Clientset, namespace, name string) (string, string, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, v1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := secret.Data["adminID"]; !ok {
+		return "", "", fmt.Errorf("adminID is empty for %v in %v namespace", name, namespace)
+	}
+	if _, ok := secret.Data["adminKey"]; !ok {
+		return "", "", fmt.Errorf("adminKey is empty for %v in %v namespace", name, namespace)
+	}
+	return string(secret.Data["adminID"]), string(secret.Data["adminKey"]), nil
+}
+
+// GetAdminUserAndKeyFromSecret returns the credentials of the ceph admin
+// created by Rook.
+func GetAdminUserAndKeyFromSecret(client *kubernetes.Clientset, namespace string) (string, string, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), AdminSecret, v1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := secret.Data["ceph-username"]; !ok {
+		return "", "", fmt.Errorf("ceph-username is empty for %v in %v namespace", AdminSecret, namespace)
+	}
+	if _, ok := secret.Data["ceph-secret"]; !ok {
+		return "", "", fmt.Errorf("ceph-secret is empty for %v in %v namespace", AdminSecret, namespace)
+	}
+	// the commands take the user ID, without the client. prefix of the user
+	// name.
+	user := strings.TrimPrefix(string(secret.Data["ceph-username"]), "client.")
+	return user, string(secret.Data["ceph-secret"]), nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// csiParameterPrefix is the prefix of the storageclass parameters which
+	// are interpreted by the CSI external components.
+	csiParameterPrefix = "csi.storage.k8s.io/"
+)
+
+func GetStorageClass(client *k8s.Clientset, name string) (*storagev1.StorageClass, error) {
+	return client.StorageV1().StorageClasses().Get(context.TODO(), name, v1.GetOptions{})
+}
+
+// ListStorageClasses returns all the storageclasses of the cluster.
+func ListStorageClasses(client *k8s.Clientset) ([]storagev1.StorageClass, error) {
+	scs, err := client.StorageV1().StorageClasses().List(context.TODO(), v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return scs.Items, nil
+}
+
+func GetStorageClassPoolName(sc *storagev1.StorageClass) string {
+	// Pool in which CSI creates the RBD images
+	if pool := sc.Parameters["pool"]; pool != "" {
+		return pool
+	}
+	// Rook flex storageclasses name it blockPool
+	return sc.Parameters["blockPool"]
+}
+
+func GetStorageClassClusterID(sc *storagev1.StorageClass) string {
+	// clusterID of the ceph cluster in which CSI creates the RBD images
+	return sc.Parameters["clusterID"]
+}
+
+// GetStorageClassImageFeatures returns the features of the rbd images CSI
+// creates, the default features of the cluster if it is empty.
+func GetStorageClassImageFeatures(sc *storagev1.StorageClass) []string {
+	var features []string
+	for _, f := range strings.Split(sc.Parameters["imageFeatures"], ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// GetStorageClassDataPool returns the pool the data of the rbd images CSI
+// creates is stored in, the pool of the images if it is empty.
+func GetStorageClassDataPool(sc *storagev1.StorageClass) string {
+	return sc.Parameters["dataPool"]
+}
+
+func GetStorageClassFSName(sc *storagev1.StorageClass) string {
+	// CephFS file system in which CSI creates the subvolumes
+	return sc.Parameters["fsName"]
+}
+
+// GetProvisionerSecret returns the secret of the CSI provisioner set in the
+// storageclass parameters, or nil if there is none.
+func GetProvisionerSecret(sc *storagev1.StorageClass) *corev1.SecretReference {
+	return secretReference(sc, "provisioner")
+}
@@ -0,0 +1,349 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// Workload kinds which can be scaled down.
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindReplicaSet  = "ReplicaSet"
+	KindDaemonSet   = "DaemonSet"
+	KindCronJob     = "CronJob"
+
+	// replicasAnnotation records the replicas of a Deployment, StatefulSet or
+	// ReplicaSet before it was scaled down.
+	replicasAnnotation = "persistent-volume-migrator/replicas"
+	// suspendAnnotation records whether a CronJob was suspended before it was
+	// scaled down.
+	suspendAnnotation = "persistent-volume-migrator/suspend"
+	// scaledDownNodeSelector is added to the node selector of a DaemonSet to
+	// evict its pods, as no node has this label.
+	scaledDownNodeSelector = "persistent-volume-migrator/scaled-down"
+)
+
+// Workload identifies a workload whose pods mount a PVC.
+type Workload struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (w Workload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.Kind, w.Namespace, w.Name)
+}
+
+// ListWorkloadsUsingPVCs returns the Deployments, StatefulSets, ReplicaSets,
+// DaemonSets and CronJobs whose pods mount any of the PVCs. ReplicaSets
+// controlled by a Deployment are left out, as scaling the Deployment scales
+// them.
+func ListWorkloadsUsingPVCs(client *k8s.Clientset, pvcs []corev1.PersistentVolumeClaim) ([]Workload, error) {
+	claims := map[string]map[string]bool{}
+	for _, pvc := range pvcs {
+		if claims[pvc.Namespace] == nil {
+			claims[pvc.Namespace] = map[string]bool{}
+		}
+		claims[pvc.Namespace][pvc.Name] = true
+	}
+
+	ctx := context.TODO()
+	listOpt := v1.ListOptions{}
+	var workloads []Workload
+	for ns, names := range claims {
+		deployments, err := client.AppsV1().Deployments(ns).List(ctx, listOpt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Deployments in namespace %s: %v", ns, err)
+		}
+		for _, d := range deployments.Items {
+			if templateUsesPVCs(&d.Spec.Template, names) { // nolint:gosec // skip gosec as d is not retained.
+				workloads = append(workloads, Workload{KindDeployment, ns, d.Name})
+			}
+		}
+
+		statefulSets, err := client.AppsV1().StatefulSets(ns).List(ctx, listOpt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list StatefulSets in namespace %s: %v", ns, err)
+		}
+		for _, s := range statefulSets.Items {
+			used := templateUsesPVCs(&s.Spec.Template, names) // nolint:gosec // skip gosec as s is not retained.
+			for _, t := range s.Spec.VolumeClaimTemplates {
+				if claimTemplateUsesPVCs(t.Name, s.Name, names) {
+					used = true
+				}
+			}
+			if used {
+				workloads = append(workloads, Workload{KindStatefulSet, ns, s.Name})
+			}
+		}
+
+		replicaSets, err := client.AppsV1().ReplicaSets(ns).List(ctx, listOpt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ReplicaSets in namespace %s: %v", ns, err)
+		}
+		for _, r := range replicaSets.Items {
+			if v1.GetControllerOf(&r) != nil { // nolint:gosec // skip gosec as r is not retained.
+				continue
+			}
+			if templateUsesPVCs(&r.Spec.Template, names) { // nolint:gosec // skip gosec as r is not retained.
+				workloads = append(workloads, Workload{KindReplicaSet, ns, r.Name})
+			}
+		}
+
+		daemonSets, err := client.AppsV1().DaemonSets(ns).List(ctx, listOpt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list DaemonSets in namespace %s: %v", ns, err)
+		}
+		for _, d := range daemonSets.Items {
+			if templateUsesPVCs(&d.Spec.Template, names) { // nolint:gosec // skip gosec as d is not retained.
+				workloads = append(workloads, Workload{KindDaemonSet, ns, d.Name})
+			}
+		}
+
+		cronJobs, err := client.BatchV1beta1().CronJobs(ns).List(ctx, listOpt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list CronJobs in namespace %s: %v", ns, err)
+		}
+		for _, c := range cronJobs.Items {
+			if templateUsesPVCs(&c.Spec.JobTemplate.Spec.Template, names) { // nolint:gosec // skip gosec as c is not retained.
+				workloads = append(workloads, Workload{KindCronJob, ns, c.Name})
+			}
+		}
+	}
+	return workloads, nil
+}
+
+func templateUsesPVCs(template *corev1.PodTemplateSpec, names map[string]bool) bool {
+	for _, volume := range template.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && names[volume.PersistentVolumeClaim.ClaimName] {
+			return true
+		}
+	}
+	return false
+}
+
+// claimTemplateUsesPVCs returns true if any of the PVCs was created from the
+// volume claim template of the StatefulSet, which names them
+// <template>-<statefulset>-<ordinal>.
+func claimTemplateUsesPVCs(template, statefulSet string, names map[string]bool) bool {
+	prefix := template + "-" + statefulSet + "-"
+	for name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, prefix)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ScaleDownWorkload stops the pods of the workload and records in its
+// annotations what is needed to restore it. Deployments, StatefulSets and
+// ReplicaSets are scaled to zero replicas, CronJobs are suspended and
+// DaemonSets get a node selector matching no node. A workload already scaled
+// down keeps the state recorded the first time, and is scaled down again if it
+// was scaled up since.
+func ScaleDownWorkload(client *k8s.Clientset, w Workload) error {
+	ctx := context.TODO()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		switch w.Kind {
+		case KindDeployment:
+			d, err := client.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if !recordReplicas(&d.ObjectMeta, d.Spec.Replicas) {
+				return nil
+			}
+			d.Spec.Replicas = new(int32)
+			_, err = client.AppsV1().Deployments(w.Namespace).Update(ctx, d, v1.UpdateOptions{})
+			return err
+		case KindStatefulSet:
+			s, err := client.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if !recordReplicas(&s.ObjectMeta, s.Spec.Replicas) {
+				return nil
+			}
+			s.Spec.Replicas = new(int32)
+			_, err = client.AppsV1().StatefulSets(w.Namespace).Update(ctx, s, v1.UpdateOptions{})
+			return err
+		case KindReplicaSet:
+			r, err := client.AppsV1().ReplicaSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if !recordReplicas(&r.ObjectMeta, r.Spec.Replicas) {
+				return nil
+			}
+			r.Spec.Replicas = new(int32)
+			_, err = client.AppsV1().ReplicaSets(w.Namespace).Update(ctx, r, v1.UpdateOptions{})
+			return err
+		case KindDaemonSet:
+			d, err := client.AppsV1().DaemonSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if _, ok := d.Spec.Template.Spec.NodeSelector[scaledDownNodeSelector]; ok {
+				return nil
+			}
+			if d.Spec.Template.Spec.NodeSelector == nil {
+				d.Spec.Template.Spec.NodeSelector = map[string]string{}
+			}
+			d.Spec.Template.Spec.NodeSelector[scaledDownNodeSelector] = "true"
+			_, err = client.AppsV1().DaemonSets(w.Namespace).Update(ctx, d, v1.UpdateOptions{})
+			return err
+		case KindCronJob:
+			c, err := client.BatchV1beta1().CronJobs(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			suspend := c.Spec.Suspend != nil && *c.Spec.Suspend
+			if _, ok := c.Annotations[suspendAnnotation]; ok {
+				if suspend {
+					return nil
+				}
+			} else {
+				v1.SetMetaDataAnnotation(&c.ObjectMeta, suspendAnnotation, strconv.FormatBool(suspend))
+			}
+			c.Spec.Suspend = &[]bool{true}[0]
+			_, err = client.BatchV1beta1().CronJobs(w.Namespace).Update(ctx, c, v1.UpdateOptions{})
+			return err
+		}
+		return fmt.Errorf("cannot scale down unknown workload kind %q", w.Kind)
+	})
+}
+
+// RestoreWorkload restores a workload scaled down by ScaleDownWorkload to the
+// state recorded in its annotations.
+func RestoreWorkload(client *k8s.Clientset, w Workload) error {
+	ctx := context.TODO()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		switch w.Kind {
+		case KindDeployment:
+			d, err := client.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			replicas, ok, err := recordedReplicas(&d.ObjectMeta)
+			if err != nil || !ok {
+				return err
+			}
+			d.Spec.Replicas = replicas
+			_, err = client.AppsV1().Deployments(w.Namespace).Update(ctx, d, v1.UpdateOptions{})
+			return err
+		case KindStatefulSet:
+			s, err := client.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			replicas, ok, err := recordedReplicas(&s.ObjectMeta)
+			if err != nil || !ok {
+				return err
+			}
+			s.Spec.Replicas = replicas
+			_, err = client.AppsV1().StatefulSets(w.Namespace).Update(ctx, s, v1.UpdateOptions{})
+			return err
+		case KindReplicaSet:
+			r, err := client.AppsV1().ReplicaSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			replicas, ok, err := recordedReplicas(&r.ObjectMeta)
+			if err != nil || !ok {
+				return err
+			}
+			r.Spec.Replicas = replicas
+			_, err = client.AppsV1().ReplicaSets(w.Namespace).Update(ctx, r, v1.UpdateOptions{})
+			return err
+		case KindDaemonSet:
+			d, err := client.AppsV1().DaemonSets(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if _, ok := d.Spec.Template.Spec.NodeSelector[scaledDownNodeSelector]; !ok {
+				return nil
+			}
+			delete(d.Spec.Template.Spec.NodeSelector, scaledDownNodeSelector)
+			_, err = client.AppsV1().DaemonSets(w.Namespace).Update(ctx, d, v1.UpdateOptions{})
+			return err
+		case KindCronJob:
+			c, err := client.BatchV1beta1().CronJobs(w.Namespace).Get(ctx, w.Name, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			value, ok := c.Annotations[suspendAnnotation]
+			if !ok {
+				return nil
+			}
+			suspend, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s annotation %q: %v", suspendAnnotation, value, err)
+			}
+			delete(c.Annotations, suspendAnnotation)
+			c.Spec.Suspend = &suspend
+			_, err = client.BatchV1beta1().CronJobs(w.Namespace).Update(ctx, c, v1.UpdateOptions{})
+			return err
+		}
+		return fmt.Errorf("cannot restore unknown workload kind %q", w.Kind)
+	})
+}
+
+// recordReplicas records the replicas in the replicas annotation, unless they
+// were already recorded, by an interrupted run for instance. It returns false
+// if the workload is already scaled down.
+func recordReplicas(meta *v1.ObjectMeta, replicas *int32) bool {
+	if _, ok := meta.Annotations[replicasAnnotation]; ok {
+		// the workload was scaled up again since, the recorded replicas are
+		// still the ones to restore.
+		return replicas == nil || *replicas != 0
+	}
+	count := int32(1)
+	if replicas != nil {
+		count = *replicas
+	}
+	v1.SetMetaDataAnnotation(meta, replicasAnnotation, strconv.Itoa(int(count)))
+	return true
+}
+
+// recordedReplicas removes the replicas annotation and returns the replicas it
+// recorded. It returns false if the annotation isn't set.
+func recordedReplicas(meta *v1.ObjectMeta) (*int32, bool, error) {
+	value, ok := meta.Annotations[replicasAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+	count, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid %s annotation %q: %v", replicasAnnotation, value, err)
+	}
+	delete(meta.Annotations, replicasAnnotation)
+	replicas := int32(count)
+	return &replicas, true, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutil
+
+import (
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecordReplicas(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+	tests := []struct {
+		name string
+		// recorded is the value of a replicas annotation set by an earlier
+		// run, if any.
+		recorded     string
+		replicas     *int32
+		wantScale    bool
+		wantRestored int32
+	}{
+		{name: "running", replicas: int32Ptr(3), wantScale: true, wantRestored: 3},
+		{name: "default replicas", replicas: nil, wantScale: true, wantRestored: 1},
+		{name: "already scaled down", recorded: "3", replicas: int32Ptr(0), wantScale: false, wantRestored: 3},
+		{name: "stale annotation", recorded: "3", replicas: int32Ptr(2), wantScale: true, wantRestored: 3},
+		{name: "stale annotation, default replicas", recorded: "3", replicas: nil, wantScale: true, wantRestored: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &v1.ObjectMeta{}
+			if tt.recorded != "" {
+				v1.SetMetaDataAnnotation(meta, replicasAnnotation, tt.recorded)
+			}
+			if got := recordReplicas(meta, tt.replicas); got != tt.wantScale {
+				t.Errorf("recordReplicas() = %v, want %v", got, tt.wantScale)
+			}
+			restored, ok, err := recordedReplicas(meta)
+			if err != nil || !ok {
+				t.Fatalf("recordedReplicas() = %v, %v", ok, err)
+			}
+			if *restored != tt.wantRestored {
+				t.Errorf("recordedReplicas() = %d, want %d", *restored, tt.wantRestored)
+			}
+			if _, ok := meta.Annotations[replicasAnnotation]; ok {
+				t.Errorf("recordedReplicas() didn't remove the annotation")
+			}
+		})
+	}
+}
+
+func TestRecordedReplicasInvalid(t *testing.T) {
+	meta := &v1.ObjectMeta{}
+	if _, ok, err := recordedReplicas(meta); ok || err != nil {
+		t.Errorf("recordedReplicas() without annotation = %v, %v", ok, err)
+	}
+	v1.SetMetaDataAnnotation(meta, replicasAnnotation, "many")
+	if _, _, err := recordedReplicas(meta); err == nil {
+		t.Errorf("recordedReplicas() with an invalid annotation didn't fail")
+	}
+}
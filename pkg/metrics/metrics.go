@@ -0,0 +1,113 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes the progress of the migrations as Prometheus
+// metrics.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	logger "persistent-volume-migrator/pkg/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pv_migrator"
+
+// The operations of the migration whose duration is measured.
+const (
+	OperationDeletePVC    = "DeletePVC"
+	OperationCreatePVC    = "CreatePVC"
+	OperationMoveToTrash  = "MoveToTrash"
+	OperationRenameVolume = "RenameVolume"
+	OperationDeletePV     = "DeletePV"
+)
+
+var (
+	// PVCsDiscovered counts the PVCs selected for migration.
+	PVCsDiscovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pvcs_discovered_total",
+		Help:      "Number of PVCs selected for migration.",
+	})
+	// PVCsMigrated counts the PVCs whose migration completed.
+	PVCsMigrated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pvcs_migrated_total",
+		Help:      "Number of PVCs whose migration completed.",
+	})
+	// PVCsFailed counts the PVCs whose migration failed.
+	PVCsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pvcs_failed_total",
+		Help:      "Number of PVCs whose migration failed.",
+	})
+	// PVCsInProgress is the number of PVCs being migrated.
+	PVCsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pvcs_in_progress",
+		Help:      "Number of PVCs being migrated.",
+	})
+	// OperationDuration measures the duration of the operations of the
+	// migration, by operation.
+	OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the operations of the migration.",
+		// from 100ms to about 7 minutes, as creating a PVC waits for its
+		// provisioning.
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 13),
+	}, []string{"operation"})
+	// RBDErrors counts the failed rbd commands, by command.
+	RBDErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rbd_errors_total",
+		Help:      "Number of failed rbd commands.",
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(PVCsDiscovered, PVCsMigrated, PVCsFailed, PVCsInProgress, OperationDuration, RBDErrors)
+}
+
+// ObserveDuration records the duration of the operation started at start.
+func ObserveDuration(operation string, start time.Time) {
+	OperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Serve serves the metrics on addr, at /metrics, in the background. It only
+// returns an error if it can't listen on addr.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.ErrorLog("failed to serve the metrics: %v", err)
+		}
+	}()
+	logger.DefaultLog("Serving the metrics on %s/metrics", listener.Addr())
+	return nil
+}
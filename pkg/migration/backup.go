@@ -0,0 +1,203 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+
+	"persistent-volume-migrator/pkg/backup"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// backupGroup returns the backup group of the objects changed by the
+// migration of the entry.
+func (e *journalEntry) backupGroup() backup.Group {
+	return backup.Group{UID: e.PVCUID, Namespace: e.PVCNamespace, Name: e.PVCName}
+}
+
+// backupPV saves the manifest of the PV before the migration of the entry
+// changes it.
+func (j *journal) backupPV(entry *journalEntry, pv *v1.PersistentVolume) error {
+	err := j.backups.SavePV(entry.backupGroup(), pv)
+	if err != nil {
+		return fmt.Errorf("failed to backup PV %s: %v", pv.Name, err)
+	}
+	return nil
+}
+
+// backupPVC saves the manifest of the PVC before the migration of the entry
+// changes it.
+func (j *journal) backupPVC(entry *journalEntry, pvc *v1.PersistentVolumeClaim) error {
+	err := j.backups.SavePVC(entry.backupGroup(), pvc)
+	if err != nil {
+		return fmt.Errorf("failed to backup PVC %s: %v", pvc.Name, err)
+	}
+	return nil
+}
+
+// RestoreManifests re-applies the manifests saved before the objects were
+// changed, read from BackupDir if it is set or from the backup ConfigMaps
+// otherwise. Only the objects which don't exist anymore are recreated, and
+// never the ones of a PVC now bound to another volume. The backups of the
+// migrations which completed are skipped unless Force is set. If PVCName and
+// PVCNamespace are set, only the manifests saved for that PVC are re-applied.
+func RestoreManifests(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	j := newJournal(client, opts)
+	backups, err := j.backups.List()
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for _, b := range backups {
+		if opts.PVCName != "" && opts.PVCNamespace != "" && (b.Name != opts.PVCName || b.Namespace != opts.PVCNamespace) {
+			continue
+		}
+		entry, err := j.get(b.UID)
+		if err != nil {
+			return err
+		}
+		if entry != nil && !opts.Force {
+			logger.DefaultLog("migration of PVC %s/%s is recorded in the journal, resume or rollback it instead", b.Namespace, b.Name)
+			continue
+		}
+		if b.Completed && !opts.Force {
+			logger.DefaultLog("migration of PVC %s/%s completed, use --force to restore its manifests", b.Namespace, b.Name)
+			continue
+		}
+		replaced, err := isReplaced(client, b)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			logger.ErrorLog("PVC %s/%s is bound to another volume, its manifests can't be restored", b.Namespace, b.Name)
+			continue
+		}
+		logger.DefaultLog("restoring the manifests saved for PVC %s/%s", b.Namespace, b.Name)
+		if err = restoreManifests(client, b); err != nil {
+			return fmt.Errorf("failed to restore the manifests of PVC %s: %v", b.Name, err)
+		}
+		restored++
+	}
+	logger.DefaultLog("Successfully restored the manifests of %d PVCs", restored)
+	return nil
+}
+
+// isReplaced returns true if the objects of the backup were replaced by the
+// ones of a migration: a PVC of the backup now exists bound to another
+// volume. Restoring the PVs would then recreate volumes which don't point to
+// their image anymore.
+func isReplaced(client *k8s.Clientset, b *backup.Backup) (bool, error) {
+	for _, saved := range b.PVCs {
+		pvc, err := k8sutil.GetPVC(client, saved.Name, saved.Namespace)
+		if apierrs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get PVC object %s: %v", saved.Name, err)
+		}
+		if pvc.Spec.VolumeName != saved.Spec.VolumeName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// restoreManifests recreates the PVs and then the PVCs of the backup which
+// don't exist. The PVs are released from the claims they were bound to, so
+// that the recreated PVCs bind to them again.
+func restoreManifests(client *k8s.Clientset, b *backup.Backup) error {
+	for _, pv := range b.PVs {
+		_, err := k8sutil.GetPV(client, pv.Name)
+		if err == nil {
+			logger.DefaultLog("PV %s already exists, skipping", pv.Name)
+			continue
+		}
+		if !apierrs.IsNotFound(err) {
+			return fmt.Errorf("failed to get PV object with name %s: %v", pv.Name, err)
+		}
+		logger.DefaultLog("Recreate PV object: %s", pv.Name)
+		pv.Spec.ClaimRef = unboundClaimRef(pv.Spec.ClaimRef)
+		_, err = k8sutil.CreatePV(client, pv)
+		if err != nil {
+			return fmt.Errorf("failed to recreate PV object %s: %v", pv.Name, err)
+		}
+	}
+
+	for _, pvc := range b.PVCs {
+		_, err := k8sutil.GetPVC(client, pvc.Name, pvc.Namespace)
+		if err == nil {
+			logger.DefaultLog("PVC %s/%s already exists, skipping", pvc.Namespace, pvc.Name)
+			continue
+		}
+		if !apierrs.IsNotFound(err) {
+			return fmt.Errorf("failed to get PVC object %s: %v", pvc.Name, err)
+		}
+		logger.DefaultLog("Recreate PVC object: %s/%s", pvc.Namespace, pvc.Name)
+		delete(pvc.Annotations, annBindCompleted)
+		delete(pvc.Annotations, annBoundByController)
+		delete(pvc.Annotations, annStorageProvisioner)
+		_, err = k8sutil.CreatePVC(client, pvc, pvcCreateTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to recreate PVC object %s: %v", pvc.Name, err)
+		}
+	}
+	return nil
+}
+
+// CleanupBackups removes the backups of the migrations which completed, read
+// from BackupDir if it is set or from the backup ConfigMaps otherwise. If
+// PVCName and PVCNamespace are set, only the backup of that PVC is removed.
+func CleanupBackups(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	store := newJournal(client, opts).backups
+	backups, err := store.List()
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, b := range backups {
+		if opts.PVCName != "" && opts.PVCNamespace != "" && (b.Name != opts.PVCName || b.Namespace != opts.PVCNamespace) {
+			continue
+		}
+		if !b.Completed {
+			continue
+		}
+		logger.DefaultLog("removing the backup of PVC %s/%s", b.Namespace, b.Name)
+		if err = store.Remove(b.Group); err != nil {
+			return err
+		}
+		removed++
+	}
+	logger.DefaultLog("Successfully removed the backups of %d PVCs", removed)
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+
+	"persistent-volume-migrator/pkg/ceph/cephfs"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// createCephFSConnection creates a connection to the ceph cluster with the
+// credentials selected by the options, the ones of the CephFS CSI provisioner
+// by default.
+func createCephFSConnection(client *k8s.Clientset, clusterID string, opts *Options) (*cephfs.Connection, error) {
+	if clusterID == "" {
+		return nil, fmt.Errorf("clusterID cannot be empty")
+	}
+	monitor, err := getMonitors(client, clusterID, opts)
+	if err != nil {
+		return nil, err
+	}
+	user, key, err := cephCredentials(client, opts, k8sutil.DefaultCephFSProvisionerSecret, k8sutil.GetCephFSUserAndKeyFromSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CephFS credentials: %v", err)
+	}
+	return cephfs.NewConnection(monitor, user, key)
+}
+
+// resolveCephFSName returns the file system of the CephFS share backing the
+// PV. The in-tree driver doesn't record it, in which case the file system of
+// the destination storageclass is used. It fails if the destination
+// storageclass isn't a CephFS storageclass or the file system doesn't exist.
+func resolveCephFSName(client *k8s.Clientset, pv *v1.PersistentVolume, opts *Options) (string, error) {
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return "", err
+	}
+	if dest.FSName == "" {
+		return "", fmt.Errorf("PV %s is a CephFS volume but destination StorageClass %s has no fsName parameter", pv.Name, dest.StorageClass)
+	}
+	fsName := k8sutil.GetCephFSName(pv)
+	if fsName == "" {
+		fsName = dest.FSName
+	}
+
+	conn, err := createCephFSConnection(client, dest.ClusterID, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	exists, err := conn.FileSystemExists(fsName)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("CephFS file system %s of PV %s doesn't exist", fsName, pv.Name)
+	}
+	logger.DefaultLog("CephFS file system is %q ", fsName)
+	return fsName, nil
+}
@@ -25,25 +25,118 @@ import (
 
 	logger "persistent-volume-migrator/pkg/log"
 
-	v1 "k8s.io/api/core/v1"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
 // createClusterConnection creates a connection to the ceph cluster.
-func createClusterConnection(client *k8s.Clientset, csiPV *v1.PersistentVolume,
-	rookNamespace, cephClusterNamespace string) (*rbd.Connection, error) {
-	poolName := k8sutil.GetCSIPoolName(csiPV)
+func createClusterConnection(client *k8s.Clientset, poolName, clusterID string, opts *Options) (*rbd.Connection, error) {
 	if poolName == "" {
-		return nil, fmt.Errorf("poolName cannot be empty in PV object")
+		return nil, fmt.Errorf("poolName cannot be empty")
 	}
 	logger.DefaultLog("csi poolname: %v ", poolName)
-	clusterID := k8sutil.GetClusterID(csiPV)
 	if clusterID == "" {
-		return nil, fmt.Errorf("clusterID cannot be empty in PV object")
+		return nil, fmt.Errorf("clusterID cannot be empty")
 	}
-	csiConfig, err := k8sutil.GetCSIConfiguration(client, rookNamespace)
+	monitor, err := getMonitors(client, clusterID, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get configmap %v", err)
+		return nil, err
+	}
+	logger.DefaultLog("clusterID: %v, monitors: %v, poolname: %v", clusterID, monitor, poolName)
+	user, key, err := rbdCredentials(client, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rbd credentials: %v", err)
+	}
+	conn, err := rbd.NewConnection(monitor, user, key, poolName, "", opts.RBDBackend)
+	if err != nil {
+		return nil, fmt.Errorf("err in GetRBDUserAndKeyFromSecret %v", err)
+	}
+	return conn, err
+}
+
+const (
+	// CredentialsProvisioner runs the ceph commands with the credentials of
+	// the CSI provisioner.
+	CredentialsProvisioner = "provisioner"
+	// CredentialsAdmin runs the ceph commands with the credentials of the
+	// ceph admin created by Rook.
+	CredentialsAdmin = "admin"
+	// CredentialsSecret runs the ceph commands with the credentials of the
+	// userID and userKey of a secret, like the ones of a dedicated user.
+	CredentialsSecret = "secret"
+)
+
+// CredentialsSources returns the supported sources of the ceph credentials.
+func CredentialsSources() []string {
+	return []string{CredentialsProvisioner, CredentialsAdmin, CredentialsSecret}
+}
+
+// rbdCredentials returns the credentials the rbd commands are run with.
+func rbdCredentials(client *k8s.Clientset, opts *Options) (string, string, error) {
+	return cephCredentials(client, opts, k8sutil.DefaultRBDProvisionerSecret, k8sutil.GetRBDUserAndKeyFromSecret)
+}
+
+// cephCredentials returns the credentials selected by the options. The
+// credentials of the CSI provisioner are read by getProvisionerCredentials,
+// from the secret of the provisioner, defaultSecret if it isn't set.
+func cephCredentials(client *k8s.Clientset, opts *Options, defaultSecret string,
+	getProvisionerCredentials func(*k8s.Clientset, string, string) (string, string, error)) (string, string, error) {
+	switch opts.Credentials {
+	case CredentialsProvisioner, "":
+		name, namespace, err := provisionerSecret(client, opts, defaultSecret)
+		if err != nil {
+			return "", "", err
+		}
+		return getProvisionerCredentials(client, namespace, name)
+	case CredentialsAdmin:
+		return k8sutil.GetAdminUserAndKeyFromSecret(client, opts.CephClusterNamespace)
+	case CredentialsSecret:
+		if opts.CredentialsSecretName == "" {
+			return "", "", fmt.Errorf("the secret of the ceph credentials isn't set")
+		}
+		return k8sutil.GetRBDUserAndKeyFromSecret(client, opts.CephClusterNamespace, opts.CredentialsSecretName)
+	}
+	return "", "", fmt.Errorf("unsupported ceph credentials %q, supported credentials: %v", opts.Credentials, CredentialsSources())
+}
+
+// provisionerSecret returns the name and namespace of the secret of the CSI
+// provisioner: the ones set by the options, or else the ones set in the
+// parameters of the destination storageclass, or else the secret created by
+// Rook in the ceph cluster namespace.
+func provisionerSecret(client *k8s.Clientset, opts *Options, defaultName string) (string, string, error) {
+	name, namespace := defaultName, opts.CephClusterNamespace
+	if opts.DestinationStorageClass != "" && opts.ProvisionerSecret == "" {
+		sc, err := k8sutil.GetStorageClass(client, opts.DestinationStorageClass)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get destination StorageClass %s: %v", opts.DestinationStorageClass, err)
+		}
+		if ref := k8sutil.GetProvisionerSecret(sc); ref != nil {
+			name = ref.Name
+			if ref.Namespace != "" {
+				namespace = ref.Namespace
+			}
+		}
+	}
+	if opts.ProvisionerSecret != "" {
+		name = opts.ProvisionerSecret
+	}
+	if opts.ProvisionerSecretNamespace != "" {
+		namespace = opts.ProvisionerSecretNamespace
+	}
+	return name, namespace, nil
+}
+
+// csiConfiguration returns the CSI configuration, from the ConfigMap of the
+// rook namespace set by the options.
+func csiConfiguration(client *k8s.Clientset, opts *Options) (k8sutil.CSIClusterConfig, error) {
+	return k8sutil.GetCSIConfiguration(client, opts.RookNamespace, opts.CSIConfigMap, opts.CSIConfigKey)
+}
+
+// getMonitors returns the monitors of the ceph cluster with the given
+// clusterID from the CSI configuration.
+func getMonitors(client *k8s.Clientset, clusterID string, opts *Options) (string, error) {
+	csiConfig, err := csiConfiguration(client, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to get configmap %v", err)
 	}
 
 	var monitor string
@@ -53,16 +146,49 @@ func createClusterConnection(client *k8s.Clientset, csiPV *v1.PersistentVolume,
 		}
 	}
 	if monitor == "" {
-		return nil, fmt.Errorf("failed to get monitor information")
+		return "", fmt.Errorf("failed to get monitor information")
 	}
-	logger.DefaultLog("clusterID: %v, monitors: %v, poolname: %v", clusterID, monitor, poolName)
-	user, key, err := k8sutil.GetRBDUserAndKeyFromSecret(client, cephClusterNamespace)
+	return monitor, nil
+}
+
+// destination describes where the CSI driver creates the images of the
+// destination storageclass.
+type destination struct {
+	StorageClass string
+	Pool         string
+	// FSName is the CephFS file system of a CephFS storageclass.
+	FSName    string
+	ClusterID string
+	Monitors  string
+	// ImageFeatures and DataPool are the settings of the rbd images
+	// created by the CSI provisioner of the storageclass.
+	ImageFeatures []string
+	DataPool      string
+}
+
+// resolveDestination reads the pool and clusterID from the parameters of the
+// destination storageclass and the monitors of that cluster from the CSI
+// configuration.
+func resolveDestination(client *k8s.Clientset, storageClass string, opts *Options) (*destination, error) {
+	dest := &destination{StorageClass: storageClass}
+	sc, err := k8sutil.GetStorageClass(client, storageClass)
 	if err != nil {
-		return nil, fmt.Errorf("err in GetRBDUserAndKeyFromSecret %v", err)
+		return dest, fmt.Errorf("failed to get destination StorageClass %s: %v", storageClass, err)
+	}
+	dest.Pool = k8sutil.GetStorageClassPoolName(sc)
+	dest.FSName = k8sutil.GetStorageClassFSName(sc)
+	dest.ImageFeatures = k8sutil.GetStorageClassImageFeatures(sc)
+	dest.DataPool = k8sutil.GetStorageClassDataPool(sc)
+	if dest.Pool == "" && dest.FSName == "" {
+		return dest, fmt.Errorf("pool parameter is missing in destination StorageClass %s", storageClass)
+	}
+	dest.ClusterID = k8sutil.GetStorageClassClusterID(sc)
+	if dest.ClusterID == "" {
+		return dest, fmt.Errorf("clusterID parameter is missing in destination StorageClass %s", storageClass)
 	}
-	conn, err := rbd.NewConnection(monitor, user, key, poolName, "")
+	dest.Monitors, err = getMonitors(client, dest.ClusterID, opts)
 	if err != nil {
-		return nil, fmt.Errorf("err in GetRBDUserAndKeyFromSecret %v", err)
+		return dest, err
 	}
-	return conn, err
+	return dest, nil
 }
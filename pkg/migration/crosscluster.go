@@ -0,0 +1,331 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"persistent-volume-migrator/pkg/ceph/rbd"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// syncSnapshotPrefix is the prefix of the snapshots the changes of the
+	// images are copied up to.
+	syncSnapshotPrefix = "pvm-sync-"
+)
+
+// SyncImages copies the images of the PVCs to the cluster of the destination
+// storageclass, while their volumes can still be in use. Each run copies the
+// changes since the previous one, so that the migration only has to copy the
+// last changes once the volumes are no longer in use.
+func SyncImages(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	err = validateResources(client, opts)
+	if err != nil {
+		return fmt.Errorf("resource validation failed: %w", err)
+	}
+	crossCluster, err := isCrossCluster(client, opts)
+	if err != nil {
+		return err
+	}
+	if !crossCluster {
+		return fmt.Errorf("the images can only be synced to another cluster, set the clusterID of the source cluster")
+	}
+
+	pvcs, err := listPVCs(client, opts)
+	if err != nil || len(*pvcs) == 0 {
+		return err
+	}
+
+	j := newJournal(client, opts)
+	results := make([]pvcResult, len(*pvcs))
+	for i, pvc := range *pvcs {
+		results[i] = pvcResult{namespace: pvc.Namespace, name: pvc.Name, uid: string(pvc.UID)}
+	}
+	runWorkers(opts.context(), results, opts.Parallelism, opts.ContinueOnError, func(i int) (*journalEntry, error) {
+		return syncPVC(client, j, &(*pvcs)[i], opts)
+	})
+	if err = summarize("sync", results); err != nil {
+		return err
+	}
+	logger.DefaultLog("Successfully synced the images of %d PVCs", len(*pvcs))
+	return nil
+}
+
+// syncPVC copies the changes of the image of the PVC since the previous sync,
+// starting the cross-cluster migration of the PVC if needed.
+func syncPVC(client *k8s.Clientset, j *journal, pvc *v1.PersistentVolumeClaim, opts *Options) (*journalEntry, error) {
+	entry, err := j.get(string(pvc.UID))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		pv, err := k8sutil.GetPV(client, pvc.Spec.VolumeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err)
+		}
+		imageName := k8sutil.GetVolumeName(pv)
+		if imageName == "" || k8sutil.IsCephFSVolume(pv) {
+			return nil, fmt.Errorf("rbd image name cannot be found in PV object %s", pv.Name)
+		}
+		entry, err = newCrossClusterEntry(client, pvc, pv, imageName, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err = j.checkpoint(entry, stepStarted); err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Mode != modeCrossCluster {
+		return entry, fmt.Errorf("PVC %s is already being migrated in %q mode", pvc.Name, entry.Mode)
+	}
+	if entry.reached(stepReclaimPolicyRetained) {
+		logger.DefaultLog("PVC %s is already being migrated after step %s, resume the migration", pvc.Name, entry.Step)
+		return entry, nil
+	}
+	logger.DefaultLog("syncing rbd image %s of PVC %q from namespace %q", entry.SourceImage, pvc.Name, pvc.Namespace)
+	return entry, syncImage(client, j, entry, opts, false)
+}
+
+// sourceOptions returns the options to connect to the source cluster of a
+// cross-cluster migration.
+func sourceOptions(opts *Options) *Options {
+	o := *opts
+	// the provisioner secret of the destination storageclass is the one of
+	// the destination cluster.
+	o.DestinationStorageClass = ""
+	if opts.SourceCephClusterNamespace != "" {
+		o.CephClusterNamespace = opts.SourceCephClusterNamespace
+		o.ProvisionerSecretNamespace = ""
+	}
+	return &o
+}
+
+// isCrossCluster returns true if the images are copied from another cluster
+// than the one of the destination storageclass.
+func isCrossCluster(client *k8s.Clientset, opts *Options) (bool, error) {
+	if opts.SourceClusterID == "" {
+		return false, nil
+	}
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return false, err
+	}
+	return opts.SourceClusterID != dest.ClusterID, nil
+}
+
+// newCrossClusterEntry creates the journal entry of the cross-cluster
+// migration of the PVC. The image is copied to the pool of the destination
+// storageclass under its own name, which must not be taken.
+func newCrossClusterEntry(client *k8s.Clientset, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume,
+	imageName string, opts *Options) (*journalEntry, error) {
+	if opts.Static {
+		return nil, fmt.Errorf("static migration of PVC %s is not supported across clusters", pvc.Name)
+	}
+	sourcePool := k8sutil.GetVolumePool(pv)
+	if sourcePool == "" {
+		return nil, fmt.Errorf("pool of rbd image %s cannot be found in PV object %s", imageName, pv.Name)
+	}
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := createClusterConnection(client, dest.Pool, dest.ClusterID, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get destination cluster config %v", err)
+	}
+	defer closeConnection(dst)
+	exists, err := dst.ImageExists(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check rbd image %s in destination cluster: %v", imageName, err)
+	}
+	if exists {
+		return nil, fmt.Errorf("rbd image %s already exists in pool %s of destination cluster %s", imageName, dest.Pool, dest.ClusterID)
+	}
+
+	entry := newJournalEntry(pvc, pv, imageName, opts.DestinationStorageClass, modeCrossCluster)
+	entry.SourcePool = sourcePool
+	entry.SourceClusterID = opts.SourceClusterID
+	entry.Pool = dest.Pool
+	entry.ClusterID = dest.ClusterID
+	return entry, nil
+}
+
+// syncImage copies the changes of the old image since the last pass to the
+// destination cluster. The first pass copies all the data, while the volume
+// can still be in use, so that the final pass, once the PVC is deleted, only
+// copies the last changes. The final pass removes the snapshots the passes
+// were made from.
+func syncImage(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options, final bool) error {
+	src, dst, err := crossClusterConnections(client, entry, opts)
+	if err != nil {
+		return err
+	}
+	defer closeConnection(src)
+	defer closeConnection(dst)
+
+	fromSnap := entry.SyncSnapshot
+	snap := fmt.Sprintf("%s%d", syncSnapshotPrefix, entry.SyncPasses+1)
+	// remove the leftovers of an interrupted pass, the copy of a first pass
+	// can't be removed while it has the snapshot.
+	if err = removeSnapshot(src, entry.SourcePool, entry.SourceImage, snap); err != nil {
+		return err
+	}
+	if err = removeSnapshot(dst, entry.Pool, entry.SourceImage, snap); err != nil {
+		return err
+	}
+	if fromSnap == "" {
+		if err = createSyncImage(client, src, dst, entry, opts); err != nil {
+			return err
+		}
+	}
+
+	err = src.CreateSnapshot(entry.SourcePool, entry.SourceImage, snap)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot %s of rbd image %s: %v", snap, entry.SourceImage, err)
+	}
+	logger.DefaultLog("Copy rbd image %s/%s@%s from cluster %s to %s/%s in cluster %s", entry.SourcePool, entry.SourceImage, snap,
+		entry.SourceClusterID, entry.Pool, entry.SourceImage, entry.ClusterID)
+	start := time.Now()
+	err = rbd.CopyDiff(src, entry.SourcePool, entry.SourceImage, fromSnap, snap, dst, entry.Pool, entry.SourceImage)
+	if err != nil {
+		return err
+	}
+	logger.DefaultLog("Copied rbd image %s in %v", entry.SourceImage, time.Since(start).Round(time.Second))
+
+	entry.SyncSnapshot = snap
+	entry.SyncPasses++
+	step := stepImageSynced
+	if final {
+		entry.SyncSnapshot = ""
+		step = stepImageFinalSynced
+	}
+	if err = j.checkpoint(entry, step); err != nil {
+		return err
+	}
+
+	// the snapshots aren't needed anymore once the pass is recorded.
+	var stale []string
+	if fromSnap != "" {
+		stale = append(stale, fromSnap)
+	}
+	if final {
+		stale = append(stale, snap)
+	}
+	for _, s := range stale {
+		if err = removeSnapshot(src, entry.SourcePool, entry.SourceImage, s); err != nil {
+			logger.ErrorLog("%v", err)
+		}
+		if err = removeSnapshot(dst, entry.Pool, entry.SourceImage, s); err != nil {
+			logger.ErrorLog("%v", err)
+		}
+	}
+	return nil
+}
+
+// createSyncImage creates the image the data of the old image is copied to in
+// the destination cluster, replacing the one of an interrupted first pass. The
+// image gets the features and data pool of the images of the destination
+// storageclass, so that it can be mapped like them.
+func createSyncImage(client *k8s.Clientset, src, dst *rbd.Connection, entry *journalEntry, opts *Options) error {
+	dest, err := resolveDestination(client, entry.DestinationStorageClass, opts)
+	if err != nil {
+		return err
+	}
+	info, err := src.Stat(entry.SourcePool, entry.SourceImage)
+	if err != nil {
+		return fmt.Errorf("failed to get rbd image %s info: %v", entry.SourceImage, err)
+	}
+	err = dst.Remove(entry.Pool, entry.SourceImage)
+	if err != nil && !errors.Is(err, rbd.ErrImageNotFound) {
+		return fmt.Errorf("failed to remove rbd image %s of an interrupted copy: %v", entry.SourceImage, err)
+	}
+	err = dst.Create(entry.Pool, entry.SourceImage, info.Size, rbd.CreateOptions{Features: dest.ImageFeatures, DataPool: dest.DataPool})
+	if err != nil {
+		return fmt.Errorf("failed to create rbd image %s in destination cluster: %v", entry.SourceImage, err)
+	}
+	return nil
+}
+
+// removeSnapshot removes the snapshot, if it exists.
+func removeSnapshot(conn *rbd.Connection, pool, imageName, snap string) error {
+	err := conn.RemoveSnapshot(pool, imageName, snap)
+	if err != nil && !errors.Is(err, rbd.ErrImageNotFound) {
+		return fmt.Errorf("failed to remove snapshot %s of rbd image %s/%s: %v", snap, pool, imageName, err)
+	}
+	return nil
+}
+
+// crossClusterConnections creates the connections to the source and the
+// destination clusters of the entry, which the caller must close.
+func crossClusterConnections(client *k8s.Clientset, entry *journalEntry, opts *Options) (*rbd.Connection, *rbd.Connection, error) {
+	src, err := createClusterConnection(client, entry.SourcePool, entry.SourceClusterID, sourceOptions(opts))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get source cluster config %v", err)
+	}
+	dst, err := createClusterConnection(client, entry.Pool, entry.ClusterID, opts)
+	if err != nil {
+		closeConnection(src)
+		return nil, nil, fmt.Errorf("failed to get destination cluster config %v", err)
+	}
+	return src, dst, nil
+}
+
+// removeCrossClusterCopy removes the copy of the old image from the
+// destination cluster and the snapshots of the old image, which is left
+// untouched by the migration.
+func removeCrossClusterCopy(client *k8s.Clientset, entry *journalEntry, opts *Options) error {
+	src, dst, err := crossClusterConnections(client, entry, opts)
+	if err != nil {
+		return err
+	}
+	defer closeConnection(src)
+	defer closeConnection(dst)
+	// the snapshot of the last pass, and the one of an interrupted pass.
+	snaps := []string{fmt.Sprintf("%s%d", syncSnapshotPrefix, entry.SyncPasses+1)}
+	if entry.SyncSnapshot != "" {
+		snaps = append(snaps, entry.SyncSnapshot)
+	}
+	for _, snap := range snaps {
+		if err = removeSnapshot(src, entry.SourcePool, entry.SourceImage, snap); err != nil {
+			return err
+		}
+		if err = removeSnapshot(dst, entry.Pool, entry.SourceImage, snap); err != nil {
+			return err
+		}
+	}
+	logger.DefaultLog("Remove the copy of rbd image %s from destination cluster %s", entry.SourceImage, entry.ClusterID)
+	err = dst.Remove(entry.Pool, entry.SourceImage)
+	if err != nil && !errors.Is(err, rbd.ErrImageNotFound) {
+		return fmt.Errorf("failed to remove the copy of rbd image %s: %v", entry.SourceImage, err)
+	}
+	return nil
+}
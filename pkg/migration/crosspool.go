@@ -0,0 +1,177 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+
+	"persistent-volume-migrator/pkg/ceph/rbd"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// checkSourcePool returns the pool of the rbd image if it has to be moved to
+// the pool of the destination storageclass, or an empty string if the image
+// is already in that pool or isn't renamed. It fails if the image is in
+// another pool and cross-pool migrations weren't requested. When the PV
+// doesn't record its pool, the image must be found in the pool of the
+// destination storageclass, where it is renamed.
+func checkSourcePool(client *k8s.Clientset, pv *v1.PersistentVolume, imageName string, mode migrationMode, opts *Options) (string, error) {
+	if mode != modeRename {
+		return "", nil
+	}
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return "", err
+	}
+	pool := k8sutil.GetVolumePool(pv)
+	if pool == "" {
+		return "", checkImageInPool(client, imageName, dest, opts)
+	}
+	if pool == dest.Pool {
+		return "", nil
+	}
+	if !opts.CrossPool {
+		return "", fmt.Errorf("rbd image %s is in pool %s but destination StorageClass %s uses pool %s, use --cross-pool to move it",
+			imageName, pool, dest.StorageClass, dest.Pool)
+	}
+	logger.DefaultLog("rbd image %s will be moved from pool %s to pool %s", imageName, pool, dest.Pool)
+	return pool, nil
+}
+
+// checkImageInPool fails if the rbd image isn't in the pool of the
+// destination storageclass.
+func checkImageInPool(client *k8s.Clientset, imageName string, dest *destination, opts *Options) error {
+	conn, err := createClusterConnection(client, dest.Pool, dest.ClusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+
+	exists, err := conn.ImageExists(imageName)
+	if err != nil {
+		return fmt.Errorf("failed to check rbd image %s in ceph cluster: %v", imageName, err)
+	}
+	if !exists {
+		return fmt.Errorf("the PV of rbd image %s has no pool and the image is not in pool %s of destination StorageClass %s",
+			imageName, dest.Pool, dest.StorageClass)
+	}
+	return nil
+}
+
+// moveImage moves the old image from its pool to the name of the CSI image in
+// the pool of the destination storageclass with an rbd live migration. Each
+// stage of the live migration is run only if the state of the target image
+// shows it wasn't completed, so that it can be resumed. The target image gets
+// the features and data pool of the images of the destination storageclass.
+func moveImage(client *k8s.Clientset, j *journal, entry *journalEntry, conn *rbd.Connection, opts *Options) error {
+	if !entry.reached(stepMigrationPrepared) {
+		exists, err := conn.ImageExists(entry.CSIImage)
+		if err != nil {
+			return fmt.Errorf("failed to check the CSI volume in ceph cluster: %v", err)
+		}
+		if !exists {
+			dest, err := resolveDestination(client, entry.DestinationStorageClass, opts)
+			if err != nil {
+				return err
+			}
+			logger.DefaultLog("Prepare migration of rbd image %s/%s to %s/%s", entry.SourcePool, entry.SourceImage, entry.Pool, entry.CSIImage)
+			err = conn.PrepareMigration(entry.SourcePool, entry.SourceImage, entry.Pool, entry.CSIImage, rbd.CreateOptions{Features: dest.ImageFeatures, DataPool: dest.DataPool})
+			if err != nil {
+				return fmt.Errorf("failed to prepare migration of rbd image %s: %v", entry.SourceImage, err)
+			}
+		}
+		if err = j.checkpoint(entry, stepMigrationPrepared); err != nil {
+			return err
+		}
+	}
+
+	state, err := conn.MigrationState(entry.Pool, entry.CSIImage)
+	if err != nil {
+		return fmt.Errorf("failed to get migration state of rbd image %s: %v", entry.CSIImage, err)
+	}
+
+	if !entry.reached(stepMigrationExecuted) {
+		if state == rbd.MigrationPrepared || state == rbd.MigrationExecuting {
+			logger.DefaultLog("Copy the data of rbd image %s to pool %s", entry.SourceImage, entry.Pool)
+			reported := -1
+			err = conn.ExecuteMigration(entry.Pool, entry.CSIImage, func(percent int) {
+				if percent/10 > reported/10 {
+					reported = percent
+					logger.DefaultLog("migration of rbd image %s: %d%% complete", entry.SourceImage, percent)
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to execute migration of rbd image %s: %v", entry.SourceImage, err)
+			}
+			state = rbd.MigrationExecuted
+		}
+		if err = j.checkpoint(entry, stepMigrationExecuted); err != nil {
+			return err
+		}
+	}
+
+	if state == rbd.MigrationExecuted {
+		logger.DefaultLog("Commit migration of rbd image %s", entry.SourceImage)
+		err = conn.CommitMigration(entry.Pool, entry.CSIImage)
+		if err != nil {
+			return fmt.Errorf("failed to commit migration of rbd image %s: %v", entry.SourceImage, err)
+		}
+	}
+	logger.DefaultLog("successfully moved volume %s/%s -> %s/%s", entry.SourcePool, entry.SourceImage, entry.Pool, entry.CSIImage)
+	return j.checkpoint(entry, stepMigrationCommitted)
+}
+
+// abortMove cancels the live migration of the old image, which restores it in
+// its pool. It fails if the live migration was already committed.
+func abortMove(client *k8s.Clientset, entry *journalEntry, opts *Options) error {
+	if entry.reached(stepMigrationCommitted) {
+		return fmt.Errorf("rbd image %s was already moved to pool %s, resume the migration instead", entry.SourceImage, entry.Pool)
+	}
+
+	logger.DefaultLog("Create new Ceph connection")
+	conn, err := createClusterConnection(client, entry.Pool, entry.ClusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	exists, err := conn.ImageExists(entry.CSIImage)
+	if err != nil {
+		return fmt.Errorf("failed to check the CSI volume in ceph cluster: %v", err)
+	}
+	if !exists {
+		// the live migration wasn't prepared.
+		return nil
+	}
+	state, err := conn.MigrationState(entry.Pool, entry.CSIImage)
+	if err != nil {
+		return fmt.Errorf("failed to get migration state of rbd image %s: %v", entry.CSIImage, err)
+	}
+	if state == "" {
+		return fmt.Errorf("rbd image %s was already moved to pool %s, resume the migration instead", entry.SourceImage, entry.Pool)
+	}
+
+	logger.DefaultLog("Abort migration of rbd image %s/%s to %s/%s", entry.SourcePool, entry.SourceImage, entry.Pool, entry.CSIImage)
+	err = conn.AbortMigration(entry.Pool, entry.CSIImage)
+	if err != nil {
+		return fmt.Errorf("failed to abort migration of rbd image %s: %v", entry.SourceImage, err)
+	}
+	return nil
+}
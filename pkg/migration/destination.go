@@ -0,0 +1,189 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// the suffixes of the names of the ceph-csi drivers, which are prefixed
+	// by the namespace of the operator.
+	rbdCSIDriverSuffix    = "rbd.csi.ceph.com"
+	cephFSCSIDriverSuffix = "cephfs.csi.ceph.com"
+)
+
+// volumeLocation is where the data of a volume is stored in the ceph
+// clusters.
+type volumeLocation struct {
+	// Pool is the pool of an rbd image, FSName the file system of a CephFS
+	// share.
+	Pool   string
+	FSName string
+	// ClusterID is the clusterID of the cluster in the CSI configuration,
+	// empty if it can't be resolved.
+	ClusterID string
+}
+
+func (l volumeLocation) String() string {
+	s := "pool " + l.Pool
+	if l.FSName != "" {
+		s = "file system " + l.FSName
+	}
+	if l.ClusterID != "" {
+		s += " of cluster " + l.ClusterID
+	}
+	return s
+}
+
+// resolveAutoDestination sets the destination storageclass to the CSI
+// storageclass which stores its volumes where the volumes of the PVCs to
+// migrate are. All the PVCs must resolve to the same storageclass.
+func resolveAutoDestination(client *k8s.Clientset, opts *Options) error {
+	if opts.DestinationStorageClass != "" {
+		return fmt.Errorf("the destination storageclass can't be set with --auto-destination")
+	}
+	if opts.SourceClusterID != "" {
+		return fmt.Errorf("the destination storageclass of a cross-cluster migration can't be resolved, set it with --destination-sc")
+	}
+	pvcs, err := listPVCs(client, opts)
+	if err != nil {
+		return err
+	}
+	if len(*pvcs) == 0 {
+		return fmt.Errorf("no PVCs to resolve the destination storageclass from")
+	}
+	csiConfig, err := csiConfiguration(client, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get the CSI configuration: %v", err)
+	}
+	scs, err := k8sutil.ListStorageClasses(client)
+	if err != nil {
+		return fmt.Errorf("failed to list storageclasses: %v", err)
+	}
+
+	resolved := map[string][]string{}
+	for _, pvc := range *pvcs {
+		pv, err := k8sutil.GetPV(client, pvc.Spec.VolumeName)
+		if err != nil {
+			return fmt.Errorf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err)
+		}
+		location := sourceLocationOf(pv, csiConfig)
+		sc, err := matchStorageClass(scs, location)
+		if err != nil {
+			return fmt.Errorf("failed to resolve the destination storageclass of PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+		resolved[sc] = append(resolved[sc], pvc.Namespace+"/"+pvc.Name)
+	}
+	if len(resolved) > 1 {
+		var matches []string
+		for sc, names := range resolved {
+			matches = append(matches, fmt.Sprintf("%s for %s", sc, strings.Join(names, ", ")))
+		}
+		sort.Strings(matches)
+		return fmt.Errorf("the PVCs resolve to several destination storageclasses, select the PVCs of one of them: %s", strings.Join(matches, "; "))
+	}
+	for sc := range resolved {
+		opts.DestinationStorageClass = sc
+	}
+	logger.DefaultLog("Resolved destination StorageClass %s", opts.DestinationStorageClass)
+	return nil
+}
+
+// sourceLocationOf returns where the volume of the flex or in-tree PV is
+// stored. The cluster of a flex volume is the namespace of its Rook cluster,
+// the one of an in-tree volume is the cluster of the CSI configuration
+// sharing its monitors.
+func sourceLocationOf(pv *v1.PersistentVolume, csiConfig k8sutil.CSIClusterConfig) volumeLocation {
+	var location volumeLocation
+	if k8sutil.IsCephFSVolume(pv) {
+		location.FSName = k8sutil.GetCephFSName(pv)
+	} else {
+		location.Pool = k8sutil.GetVolumePool(pv)
+	}
+
+	location.ClusterID = k8sutil.GetFlexClusterNamespace(pv)
+	var monitors []string
+	if pv.Spec.RBD != nil {
+		monitors = pv.Spec.RBD.CephMonitors
+	} else if pv.Spec.CephFS != nil {
+		monitors = pv.Spec.CephFS.Monitors
+	}
+	for _, entry := range csiConfig {
+		if location.ClusterID != "" {
+			break
+		}
+		for _, monitor := range entry.Monitors {
+			if containsString(monitors, monitor) {
+				location.ClusterID = entry.ClusterID
+				break
+			}
+		}
+	}
+	return location
+}
+
+// matchStorageClass returns the name of the only ceph-csi storageclass which
+// stores its volumes at the location. The cluster is only compared if it is
+// known.
+func matchStorageClass(scs []storagev1.StorageClass, location volumeLocation) (string, error) {
+	if location.Pool == "" && location.FSName == "" {
+		return "", fmt.Errorf("the PV doesn't record the pool or the file system of its volume")
+	}
+	var matches []string
+	for i := range scs {
+		sc := &scs[i]
+		if location.ClusterID != "" && k8sutil.GetStorageClassClusterID(sc) != location.ClusterID {
+			continue
+		}
+		if location.FSName != "" {
+			if strings.HasSuffix(sc.Provisioner, cephFSCSIDriverSuffix) && k8sutil.GetStorageClassFSName(sc) == location.FSName {
+				matches = append(matches, sc.Name)
+			}
+			continue
+		}
+		if strings.HasSuffix(sc.Provisioner, rbdCSIDriverSuffix) && k8sutil.GetStorageClassPoolName(sc) == location.Pool {
+			matches = append(matches, sc.Name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no CSI storageclass uses %s", location)
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("several CSI storageclasses use %s: %s, set the destination storageclass with --destination-sc", location, strings.Join(matches, ", "))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// eventComponent is the source of the events recorded by the migrations.
+	eventComponent = "persistent-volume-migrator"
+	// eventFlushTimeout bounds the time spent sending the last events once
+	// the migrations are done.
+	eventFlushTimeout = 5 * time.Second
+
+	reasonMigrationStarted   = "MigrationStarted"
+	reasonMigrationSucceeded = "MigrationSucceeded"
+	reasonMigrationFailed    = "MigrationFailed"
+)
+
+// eventRecorder records events on the PVCs and PVs being migrated, so that
+// their owners can follow the migration with kubectl describe. A nil
+// eventRecorder records nothing.
+type eventRecorder struct {
+	client      *k8s.Clientset
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	// emitted and written count the events recorded and the events sent to
+	// the API server, as the events are sent asynchronously.
+	emitted int64
+	written int64
+}
+
+func newEventRecorder(client *k8s.Clientset) *eventRecorder {
+	r := &eventRecorder{client: client, broadcaster: record.NewBroadcaster()}
+	r.broadcaster.StartRecordingToSink(&countingSink{
+		EventSink: &typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")},
+		written:   &r.written,
+	})
+	r.recorder = r.broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+	return r
+}
+
+// record records an event on the PVC of the entry and on its old and CSI PVs,
+// the ones of them which exist.
+func (r *eventRecorder) record(entry *journalEntry, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	for _, obj := range r.involvedObjects(entry) {
+		atomic.AddInt64(&r.emitted, 1)
+		r.recorder.Event(obj, eventType, reason, message)
+	}
+}
+
+// recordPVC records an event on the PVC alone, for the migrations which
+// failed before their journal entry was created.
+func (r *eventRecorder) recordPVC(pvc *v1.PersistentVolumeClaim, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.emitted, 1)
+	r.recorder.Eventf(pvc, eventType, reason, messageFmt, args...)
+}
+
+// involvedObjects returns the PVC currently bound to the name of the PVC of
+// the entry, the old PV and the CSI PV, the ones of them which exist.
+func (r *eventRecorder) involvedObjects(entry *journalEntry) []runtime.Object {
+	var objs []runtime.Object
+	if pvc, err := k8sutil.GetPVC(r.client, entry.PVCName, entry.PVCNamespace); err == nil {
+		objs = append(objs, pvc)
+	}
+	names := []string{entry.PVName}
+	if entry.CSIPVName != "" && entry.CSIPVName != entry.PVName {
+		names = append(names, entry.CSIPVName)
+	}
+	for _, name := range names {
+		if pv, err := k8sutil.GetPV(r.client, name); err == nil {
+			objs = append(objs, pv)
+		}
+	}
+	return objs
+}
+
+// close waits for the recorded events to be sent, for at most
+// eventFlushTimeout, and stops the recorder.
+func (r *eventRecorder) close() {
+	if r == nil {
+		return
+	}
+	err := wait.PollImmediate(100*time.Millisecond, eventFlushTimeout, func() (bool, error) {
+		return atomic.LoadInt64(&r.written) >= atomic.LoadInt64(&r.emitted), nil
+	})
+	if err != nil {
+		logger.ErrorLog("some events of the migration may not have been recorded: %v", err)
+	}
+	r.broadcaster.Shutdown()
+}
+
+// countingSink counts the events written to the API server.
+type countingSink struct {
+	record.EventSink
+	written *int64
+}
+
+func (s *countingSink) Create(event *v1.Event) (*v1.Event, error) {
+	defer atomic.AddInt64(s.written, 1)
+	return s.EventSink.Create(event)
+}
+
+func (s *countingSink) Update(event *v1.Event) (*v1.Event, error) {
+	defer atomic.AddInt64(s.written, 1)
+	return s.EventSink.Update(event)
+}
+
+func (s *countingSink) Patch(oldEvent *v1.Event, data []byte) (*v1.Event, error) {
+	defer atomic.AddInt64(s.written, 1)
+	return s.EventSink.Patch(oldEvent, data)
+}
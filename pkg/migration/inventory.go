@@ -0,0 +1,206 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	InventoryFormatTable = "table"
+	InventoryFormatJSON  = "json"
+
+	// the drivers of the in-tree volumes.
+	inTreeRBDDriver    = "kubernetes.io/rbd"
+	inTreeCephFSDriver = "kubernetes.io/cephfs"
+)
+
+// InventoryFormats returns the supported inventory formats.
+func InventoryFormats() []string {
+	return []string{InventoryFormatTable, InventoryFormatJSON}
+}
+
+// inventoryVolume is a ceph volume which isn't provisioned by a CSI driver.
+type inventoryVolume struct {
+	PV     string `json:"pv"`
+	Driver string `json:"driver"`
+	// Type is rbd or cephfs.
+	Type         string   `json:"type"`
+	Phase        string   `json:"phase"`
+	PVCNamespace string   `json:"pvcNamespace,omitempty"`
+	PVC          string   `json:"pvc,omitempty"`
+	StorageClass string   `json:"storageClass,omitempty"`
+	Size         string   `json:"size"`
+	AccessModes  []string `json:"accessModes"`
+	VolumeMode   string   `json:"volumeMode"`
+	Pods         []string `json:"pods,omitempty"`
+	// Pool and Image locate the rbd image of the rbd volumes.
+	Pool  string `json:"pool,omitempty"`
+	Image string `json:"image,omitempty"`
+	// FSName and Path locate the share of the CephFS volumes. FSName is
+	// empty for the in-tree volumes, which don't record it.
+	FSName string `json:"fsName,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// Inventory prints every PV of the cluster provisioned by the Rook flex
+// driver or by the in-tree rbd and cephfs drivers, in the given format. It
+// doesn't change anything.
+func Inventory(opts *Options, format string) error {
+	if format != InventoryFormatTable && format != InventoryFormatJSON {
+		return fmt.Errorf("unsupported inventory format %q, supported formats: %v", format, InventoryFormats())
+	}
+
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	pvs, err := k8sutil.ListPVs(client)
+	if err != nil {
+		return fmt.Errorf("failed to list PVs: %v", err)
+	}
+	pods, err := k8sutil.ListRunningPods(client, "")
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	volumes := []inventoryVolume{}
+	for i := range pvs {
+		if volume, ok := newInventoryVolume(&pvs[i], pods); ok {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Slice(volumes, func(i, k int) bool {
+		return volumes[i].PV < volumes[k].PV
+	})
+	logger.DefaultLog("%d non-CSI ceph volumes found", len(volumes))
+
+	if format == InventoryFormatJSON {
+		return writeInventoryJSON(os.Stdout, volumes)
+	}
+	return writeInventoryTable(os.Stdout, volumes)
+}
+
+// newInventoryVolume returns the inventory of the PV, and false if the PV
+// isn't a flex or in-tree ceph volume.
+func newInventoryVolume(pv *v1.PersistentVolume, pods []v1.Pod) (inventoryVolume, bool) {
+	volume := inventoryVolume{
+		PV:           pv.Name,
+		Phase:        string(pv.Status.Phase),
+		StorageClass: pv.Spec.StorageClassName,
+		VolumeMode:   string(v1.PersistentVolumeFilesystem),
+	}
+	switch {
+	case k8sutil.IsFlexVolume(pv):
+		volume.Driver = pv.Spec.FlexVolume.Driver
+	case pv.Spec.RBD != nil:
+		volume.Driver = inTreeRBDDriver
+	case pv.Spec.CephFS != nil:
+		volume.Driver = inTreeCephFSDriver
+	default:
+		return volume, false
+	}
+
+	if k8sutil.IsCephFSVolume(pv) {
+		volume.Type = "cephfs"
+		volume.FSName = k8sutil.GetCephFSName(pv)
+		volume.Path = k8sutil.GetCephFSPath(pv)
+	} else {
+		volume.Type = "rbd"
+		volume.Pool = k8sutil.GetVolumePool(pv)
+		volume.Image = k8sutil.GetVolumeName(pv)
+	}
+	if size, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		volume.Size = size.String()
+	}
+	for _, mode := range pv.Spec.AccessModes {
+		volume.AccessModes = append(volume.AccessModes, string(mode))
+	}
+	if pv.Spec.VolumeMode != nil {
+		volume.VolumeMode = string(*pv.Spec.VolumeMode)
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil && pv.Status.Phase == v1.VolumeBound {
+		volume.PVCNamespace = ref.Namespace
+		volume.PVC = ref.Name
+		for i := range pods {
+			if pods[i].Namespace == ref.Namespace && k8sutil.PodUsesPVC(&pods[i], ref.Name) {
+				volume.Pods = append(volume.Pods, pods[i].Name)
+			}
+		}
+	}
+	return volume, true
+}
+
+func writeInventoryJSON(w io.Writer, volumes []inventoryVolume) error {
+	data, err := json.MarshalIndent(volumes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize the inventory: %w", err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// accessModeNames are the short names of the access modes, as printed by
+// kubectl.
+var accessModeNames = map[string]string{
+	string(v1.ReadWriteOnce): "RWO",
+	string(v1.ReadOnlyMany):  "ROX",
+	string(v1.ReadWriteMany): "RWX",
+}
+
+func writeInventoryTable(w io.Writer, volumes []inventoryVolume) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PV\tDRIVER\tTYPE\tPVC\tSTORAGECLASS\tSIZE\tACCESS MODES\tVOLUMEMODE\tPODS\tVOLUME")
+	for _, v := range volumes {
+		pvc := v.PVCNamespace + "/" + v.PVC
+		if v.PVC == "" {
+			pvc = "<" + strings.ToLower(v.Phase) + ">"
+		}
+		var modes []string
+		for _, mode := range v.AccessModes {
+			modes = append(modes, accessModeNames[mode])
+		}
+		location := v.Pool + "/" + v.Image
+		if v.Type == "cephfs" {
+			location = v.FSName + ":" + v.Path
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", v.PV, v.Driver, v.Type, pvc, orNone(v.StorageClass), v.Size,
+			strings.Join(modes, ","), v.VolumeMode, orNone(strings.Join(v.Pods, ",")), location)
+	}
+	return tw.Flush()
+}
+
+// orNone returns s, or <none> if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
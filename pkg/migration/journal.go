@@ -0,0 +1,335 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"persistent-volume-migrator/pkg/backup"
+	"persistent-volume-migrator/pkg/k8sutil"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// journalConfigMapName is the name of the ConfigMap, created in the rook
+	// namespace, which records the progress of every PVC migration.
+	journalConfigMapName = "persistent-volume-migrator-journal"
+)
+
+// migrationStep is the last step completed by a PVC migration.
+type migrationStep string
+
+const (
+	stepStarted               migrationStep = "Started"
+	stepReclaimPolicyRetained migrationStep = "ReclaimPolicyRetained"
+	stepPVCDeleted            migrationStep = "PVCDeleted"
+	stepCSIPVCCreated         migrationStep = "CSIPVCCreated"
+	stepPlaceholderRemoved    migrationStep = "PlaceholderRemoved"
+	stepImageRenamed          migrationStep = "ImageRenamed"
+	stepPVDeleted             migrationStep = "PVDeleted"
+	stepStaticPVCreated       migrationStep = "StaticPVCreated"
+	stepMigrationPrepared     migrationStep = "MigrationPrepared"
+	stepMigrationExecuted     migrationStep = "MigrationExecuted"
+	stepMigrationCommitted    migrationStep = "MigrationCommitted"
+	stepImageSynced           migrationStep = "ImageSynced"
+	stepImageFinalSynced      migrationStep = "ImageFinalSynced"
+	stepSnapshotCreated       migrationStep = "SnapshotCreated"
+)
+
+// migrationMode is the way the PVC is moved to the destination storageclass.
+type migrationMode string
+
+const (
+	// modeRename provisions a CSI volume, removes its image and renames the
+	// old image to the name of the CSI image.
+	modeRename migrationMode = ""
+	// modeStatic creates a static CSI PV pointing to the old image.
+	modeStatic migrationMode = "static"
+	// modeCephFS creates a static CephFS CSI PV mounting the path of the old
+	// CephFS share.
+	modeCephFS migrationMode = "cephfs"
+	// modeCrossPool provisions a CSI volume, removes its image and moves the
+	// old image from its pool to the name of the CSI image with an rbd live
+	// migration.
+	modeCrossPool migrationMode = "cross-pool"
+	// modeCrossCluster copies the old image to the cluster of the destination
+	// storageclass, provisions a CSI volume, removes its image and renames
+	// the copy to the name of the CSI image. The old image is left untouched.
+	modeCrossCluster migrationMode = "cross-cluster"
+)
+
+// migrationSteps lists the steps of a migration in the order they are run.
+var migrationSteps = map[migrationMode][]migrationStep{
+	modeRename: {
+		stepStarted,
+		stepSnapshotCreated,
+		stepReclaimPolicyRetained,
+		stepPVCDeleted,
+		stepCSIPVCCreated,
+		stepPlaceholderRemoved,
+		stepImageRenamed,
+		stepPVDeleted,
+	},
+	modeStatic: {
+		stepStarted,
+		stepSnapshotCreated,
+		stepReclaimPolicyRetained,
+		stepPVCDeleted,
+		stepPVDeleted,
+		stepStaticPVCreated,
+		stepCSIPVCCreated,
+	},
+	modeCrossPool: {
+		stepStarted,
+		stepSnapshotCreated,
+		stepReclaimPolicyRetained,
+		stepPVCDeleted,
+		stepCSIPVCCreated,
+		stepPlaceholderRemoved,
+		stepMigrationPrepared,
+		stepMigrationExecuted,
+		stepMigrationCommitted,
+		stepPVDeleted,
+	},
+	modeCrossCluster: {
+		stepStarted,
+		stepImageSynced,
+		stepReclaimPolicyRetained,
+		stepPVCDeleted,
+		stepImageFinalSynced,
+		stepCSIPVCCreated,
+		stepPlaceholderRemoved,
+		stepImageRenamed,
+		stepPVDeleted,
+	},
+	modeCephFS: {
+		stepStarted,
+		stepReclaimPolicyRetained,
+		stepPVCDeleted,
+		stepPVDeleted,
+		stepStaticPVCreated,
+		stepCSIPVCCreated,
+	},
+}
+
+// journalEntry holds everything needed to continue the migration of a single
+// PVC after the process was interrupted. For CephFS volumes, SourceImage and
+// CSIImage hold the path of the share. TrashImage is the name the placeholder
+// image is renamed to before it is moved to the trash.
+type journalEntry struct {
+	PVCUID                  string                    `json:"pvcUID"`
+	PVCName                 string                    `json:"pvcName"`
+	PVCNamespace            string                    `json:"pvcNamespace"`
+	PVName                  string                    `json:"pvName"`
+	Mode                    migrationMode             `json:"mode,omitempty"`
+	DestinationStorageClass string                    `json:"destinationStorageClass"`
+	SourceImage             string                    `json:"sourceImage"`
+	SourcePool              string                    `json:"sourcePool,omitempty"`
+	SourceClusterID         string                    `json:"sourceClusterID,omitempty"`
+	SyncSnapshot            string                    `json:"syncSnapshot,omitempty"`
+	SyncPasses              int                       `json:"syncPasses,omitempty"`
+	Snapshot                string                    `json:"snapshot,omitempty"`
+	MetadataChanges         []string                  `json:"metadataChanges,omitempty"`
+	FSName                  string                    `json:"fsName,omitempty"`
+	CSIPVName               string                    `json:"csiPVName,omitempty"`
+	CSIImage                string                    `json:"csiImage,omitempty"`
+	TrashImage              string                    `json:"trashImage,omitempty"`
+	Pool                    string                    `json:"pool,omitempty"`
+	ClusterID               string                    `json:"clusterID,omitempty"`
+	Step                    migrationStep             `json:"step"`
+	UpdatedAt               time.Time                 `json:"updatedAt"`
+	OriginalPVC             *v1.PersistentVolumeClaim `json:"originalPVC"`
+	OriginalPV              *v1.PersistentVolume      `json:"originalPV"`
+}
+
+// steps returns the steps of the migration, in the order they are run.
+func (e *journalEntry) steps() []migrationStep {
+	return migrationSteps[e.Mode]
+}
+
+// isStatic returns true if the migration binds the PVC to a static CSI PV
+// instead of a PV provisioned by the CSI driver.
+func (e *journalEntry) isStatic() bool {
+	return e.Mode == modeStatic || e.Mode == modeCephFS
+}
+
+// reached returns true if the given step has already been completed. Steps
+// which aren't part of the migration mode of the entry are never reached.
+func (e *journalEntry) reached(step migrationStep) bool {
+	index := e.stepIndex(step)
+	return index >= 0 && e.stepIndex(e.Step) >= index
+}
+
+func (e *journalEntry) stepIndex(step migrationStep) int {
+	for i, s := range e.steps() {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// journal persists journal entries, keyed by PVC UID, in a ConfigMap.
+type journal struct {
+	client    *k8s.Clientset
+	namespace string
+	// backups saves the manifests of the objects changed by the migrations.
+	backups *backup.Store
+	// events records the steps of the migrations on the PVCs and PVs, nil if
+	// no events are recorded.
+	events *eventRecorder
+	// mu serializes the updates of the journal by the migration workers.
+	mu sync.Mutex
+}
+
+func newJournal(client *k8s.Clientset, opts *Options) *journal {
+	return &journal{
+		client:    client,
+		namespace: opts.RookNamespace,
+		backups:   backup.NewStore(client, opts.RookNamespace, opts.BackupDir),
+	}
+}
+
+// data returns the content of the journal. Reading the journal never creates
+// the ConfigMap, so that it can be used in dry-run mode.
+func (j *journal) data() (map[string]string, error) {
+	cm, err := k8sutil.GetConfigMap(j.client, j.namespace, journalConfigMapName)
+	if apierrs.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get journal configmap: %w", err)
+	}
+	return cm.Data, nil
+}
+
+// get returns the entry for the given PVC UID, or nil if there is none.
+func (j *journal) get(pvcUID string) (*journalEntry, error) {
+	entries, err := j.data()
+	if err != nil {
+		return nil, err
+	}
+	data, ok := entries[pvcUID]
+	if !ok {
+		return nil, nil
+	}
+	entry := &journalEntry{}
+	if err = json.Unmarshal([]byte(data), entry); err != nil {
+		return nil, fmt.Errorf("failed to parse journal entry for PVC %s: %w", pvcUID, err)
+	}
+	return entry, nil
+}
+
+// list returns all the entries of the journal, oldest first.
+func (j *journal) list() ([]*journalEntry, error) {
+	all, err := j.data()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*journalEntry{}
+	for uid, data := range all {
+		entry := &journalEntry{}
+		if err = json.Unmarshal([]byte(data), entry); err != nil {
+			return nil, fmt.Errorf("failed to parse journal entry for PVC %s: %w", uid, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].UpdatedAt.Before(entries[k].UpdatedAt)
+	})
+	return entries, nil
+}
+
+// checkpoint records that the given step of the migration has been completed.
+func (j *journal) checkpoint(entry *journalEntry, step migrationStep) error {
+	changed := entry.Step != step
+	entry.Step = step
+	entry.UpdatedAt = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize journal entry for PVC %s: %w", entry.PVCUID, err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := k8sutil.GetOrCreateConfigMap(j.client, j.namespace, journalConfigMapName)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[entry.PVCUID] = string(data)
+		return k8sutil.UpdateConfigMap(j.client, cm)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record step %s for PVC %s in journal: %w", step, entry.PVCName, err)
+	}
+	// the start of the migration has an event of its own.
+	if changed && step != stepStarted {
+		j.events.record(entry, v1.EventTypeNormal, string(step), "Migration of PVC %s/%s to storageclass %s: step %s completed",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass, step)
+	}
+	return nil
+}
+
+// remove deletes the entry of a PVC whose migration is complete.
+func (j *journal) remove(pvcUID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := k8sutil.GetConfigMap(j.client, j.namespace, journalConfigMapName)
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := cm.Data[pvcUID]; !ok {
+			return nil
+		}
+		delete(cm.Data, pvcUID)
+		return k8sutil.UpdateConfigMap(j.client, cm)
+	})
+}
+
+// newJournalEntry creates the entry for a PVC which is about to be migrated.
+func newJournalEntry(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, sourceImage, destinationStorageClass string, mode migrationMode) *journalEntry {
+	originalPVC := pvc.DeepCopy()
+	originalPVC.ManagedFields = nil
+	originalPV := pv.DeepCopy()
+	originalPV.ManagedFields = nil
+	return &journalEntry{
+		PVCUID:                  string(pvc.UID),
+		PVCName:                 pvc.Name,
+		PVCNamespace:            pvc.Namespace,
+		PVName:                  pv.Name,
+		Mode:                    mode,
+		DestinationStorageClass: destinationStorageClass,
+		SourceImage:             sourceImage,
+		OriginalPVC:             originalPVC,
+		OriginalPV:              originalPV,
+	}
+}
@@ -1,14 +1,19 @@
 package migration
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"persistent-volume-migrator/pkg/ceph/rbd"
 	"persistent-volume-migrator/pkg/k8sutil"
 	logger "persistent-volume-migrator/pkg/log"
+	"persistent-volume-migrator/pkg/metrics"
+	"persistent-volume-migrator/pkg/report"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
@@ -16,145 +21,754 @@ const (
 	pvcCreateTimeout = 5
 )
 
-func MigrateToCSI(kubeConfig, sourceStorageClass, destinationStorageClass, rookNamespace, cephClusterNamespace, pvcName, pvcNamespace string) error {
+// Options holds the settings of a migration run.
+type Options struct {
+	KubeConfig              string
+	SourceStorageClass      string
+	DestinationStorageClass string
+	RookNamespace           string
+	CephClusterNamespace    string
+	PVCName                 string
+	PVCNamespace            string
+	// DryRun prints the operations of the migration without running them.
+	DryRun bool
+	// AutoDestination sets the destination storageclass to the CSI
+	// storageclass using the pool and cluster of the volumes to migrate.
+	AutoDestination bool
+	// Static binds the PVC to a static CSI PV pointing to the old image
+	// instead of renaming the old image.
+	Static bool
+	// CrossPool moves the rbd images which aren't in the pool of the
+	// destination storageclass with an rbd live migration.
+	CrossPool bool
+	// SourceClusterID is the clusterID, in the CSI configuration, of the
+	// cluster of the old images, if it isn't the cluster of the destination
+	// storageclass. The images are then copied to the destination cluster.
+	SourceClusterID string
+	// SourceCephClusterNamespace is the namespace of the CSI provisioner
+	// secret of the source cluster, CephClusterNamespace if empty.
+	SourceCephClusterNamespace string
+	// TrashDelay is the period during which the placeholder images moved to
+	// the trash can't be purged.
+	TrashDelay time.Duration
+	// BackupDir is the directory the manifests of the objects changed by the
+	// migration are saved to, in addition to the backup ConfigMaps.
+	BackupDir string
+	// CSIConfigMap and CSIConfigKey locate the CSI configuration in the
+	// rook namespace, the ones created by Rook are used if they are empty.
+	CSIConfigMap string
+	CSIConfigKey string
+	// ProvisionerSecret and ProvisionerSecretNamespace override the secret
+	// of the CSI provisioner set in the destination storageclass.
+	ProvisionerSecret          string
+	ProvisionerSecretNamespace string
+	// Credentials selects the credentials all the ceph commands are run
+	// with, one of CredentialsSources(). CredentialsSecretName is the secret
+	// holding them when Credentials is CredentialsSecret.
+	Credentials           string
+	CredentialsSecretName string
+	// RBDBackend is the backend used to manage the rbd images.
+	RBDBackend string
+	// Force migrates the PVCs even if their volume is still in use.
+	Force bool
+	// ScaleWorkloads scales down the workloads using the PVCs before the
+	// migration and restores them afterwards.
+	ScaleWorkloads bool
+	// Parallelism is the number of PVCs migrated concurrently.
+	Parallelism int
+	// ContinueOnError carries on migrating the other PVCs when the migration
+	// of a PVC fails.
+	ContinueOnError bool
+	// Filter selects the PVCs of the source storageclass to migrate, when
+	// no single PVC is given.
+	Filter k8sutil.PVCFilter
+	// ResumeSelected limits ResumeMigration to the migrations of the PVCs of
+	// the source storageclass selected by the filter, to the destination
+	// storageclass.
+	ResumeSelected bool
+	// MetadataPolicy selects the metadata of the PVCs carried over to the
+	// PVCs created in the destination storageclass.
+	MetadataPolicy k8sutil.MetadataPolicy
+	// Context, if set, interrupts the run once it is done: no new PVC
+	// migration is started, and the ones running are completed.
+	Context context.Context
+	// Progress, if set, is called with the progress of the migration of
+	// every PVC. It is called concurrently by the migration workers.
+	Progress func(PVCProgress)
+	// ReportFile is the file the report of the run is written to, in
+	// ReportFormat. No report is written if it is empty.
+	ReportFile   string
+	ReportFormat string
+}
+
+// context returns the context of the run, which is never done if it isn't
+// set.
+func (o *Options) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+func MigrateToCSI(opts *Options) error {
+	start := time.Now()
+	if opts.ReportFile != "" && !opts.DryRun {
+		if err := report.CheckFormat(opts.ReportFormat); err != nil {
+			return err
+		}
+	}
+	if err := opts.MetadataPolicy.Validate(); err != nil {
+		return err
+	}
+
 	// Create Kubernetes Client
 	logger.DefaultLog("Create Kubernetes Client")
-	client, err := k8sutil.NewClient(kubeConfig)
+	client, err := k8sutil.NewClient(opts.KubeConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create kubernetes client: %v", err)
 	}
 
-	err = validateResources(client, sourceStorageClass, destinationStorageClass, rookNamespace, cephClusterNamespace)
+	if opts.AutoDestination {
+		if err = resolveAutoDestination(client, opts); err != nil {
+			return err
+		}
+	}
+
+	err = validateResources(client, opts)
 	if err != nil {
 		return errors.Wrap(err, "resource validation failed")
 	}
 
+	pvcs, err := listPVCs(client, opts)
+	if err != nil || len(*pvcs) == 0 {
+		return err
+	}
+
+	j := newJournal(client, opts)
+	if opts.DryRun {
+		return planMigration(client, j, *pvcs, opts)
+	}
+
+	if opts.ScaleWorkloads {
+		workloads, err := scaleDownWorkloads(client, *pvcs)
+		defer restoreWorkloads(client, workloads)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.DefaultLog("Start Migration of PVCs to CSI with %d workers", opts.Parallelism)
+	j.events = newEventRecorder(client)
+	defer j.events.close()
+	results := make([]pvcResult, len(*pvcs))
+	for i, pvc := range *pvcs {
+		results[i] = pvcResult{namespace: pvc.Namespace, name: pvc.Name, uid: string(pvc.UID)}
+	}
+	runWorkers(opts.context(), results, opts.Parallelism, opts.ContinueOnError, withProgress(opts, results, func(i int) (*journalEntry, error) {
+		return migratePVC(client, j, (*pvcs)[i], opts)
+	}))
+	reportErr := writeReport(results, start, opts)
+	if err = summarize("migrate", results); err != nil {
+		return err
+	}
+	if reportErr != nil {
+		return reportErr
+	}
+	logger.DefaultLog("Successfully migrated all the PVCs to CSI")
+
+	return nil
+}
+
+// listPVCs lists the PVCs to migrate: the PVC given by PVCName and
+// PVCNamespace, or the PVCs of the source storageclass selected by the
+// filter.
+func listPVCs(client *k8s.Clientset, opts *Options) (*[]v1.PersistentVolumeClaim, error) {
 	logger.DefaultLog("List all the PVC from the source storageclass")
 	var pvcs *[]v1.PersistentVolumeClaim
-	if pvcNamespace != "" && pvcName != "" {
-		pvcs, err = k8sutil.ListSinglePVCWithStorageclass(client, pvcName, pvcNamespace)
+	var err error
+	if opts.PVCNamespace != "" && opts.PVCName != "" {
+		pvcs, err = k8sutil.ListSinglePVCWithStorageclass(client, opts.PVCName, opts.PVCNamespace)
 		if err != nil {
-			return fmt.Errorf("failed to list PVCs from the pvc name %s and pvc namespace %s : %v", pvcName, pvcNamespace, err)
+			return nil, fmt.Errorf("failed to list PVCs from the pvc name %s and pvc namespace %s : %v", opts.PVCName, opts.PVCNamespace, err)
 		}
 		if pvcs == nil || len(*pvcs) == 0 {
-			logger.DefaultLog("no PVCs found with the pvc name %s and pvc namespace %s : %v", pvcName, pvcNamespace, err)
-			return nil
+			logger.DefaultLog("no PVCs found with the pvc name %s and pvc namespace %s : %v", opts.PVCName, opts.PVCNamespace, err)
+			return &[]v1.PersistentVolumeClaim{}, nil
 		}
 	} else {
-		pvcs, err = k8sutil.ListAllPVCWithStorageclass(client, sourceStorageClass)
+		if err = opts.Filter.Validate(); err != nil {
+			return nil, err
+		}
+		pvcs, err = k8sutil.ListAllPVCWithStorageclass(client, opts.SourceStorageClass, &opts.Filter)
 		if err != nil {
-			return fmt.Errorf("failed to list PVCs from the storageclass: %v", err)
+			return nil, fmt.Errorf("failed to list PVCs from the storageclass: %v", err)
 		}
 		if pvcs == nil || len(*pvcs) == 0 {
-			logger.DefaultLog("no PVCs found with storageclass: %v", sourceStorageClass)
-			return nil
+			logger.DefaultLog("no PVCs found with storageclass: %v", opts.SourceStorageClass)
+			return &[]v1.PersistentVolumeClaim{}, nil
+		}
+	}
+
+	logger.DefaultLog("%d PVCs found with source StorageClass %s ", len(*pvcs), opts.SourceStorageClass)
+
+	return pvcs, nil
+}
+
+// ResumeMigration continues the migrations recorded in the journal which were
+// interrupted before completion. If PVCName and PVCNamespace are set, only the
+// migration of that PVC is resumed.
+func ResumeMigration(opts *Options) error {
+	start := time.Now()
+	if opts.ReportFile != "" {
+		if err := report.CheckFormat(opts.ReportFormat); err != nil {
+			return err
 		}
 	}
+	if err := opts.MetadataPolicy.Validate(); err != nil {
+		return err
+	}
 
-	logger.DefaultLog("%d PVCs found with source StorageClass %s ", len(*pvcs), sourceStorageClass)
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	j := newJournal(client, opts)
+	entries, err := j.list()
+	if err != nil {
+		return err
+	}
+
+	var selected []*journalEntry
+	nsLabels := map[string]map[string]string{}
+	for _, entry := range entries {
+		if opts.PVCName != "" && opts.PVCNamespace != "" && (entry.PVCName != opts.PVCName || entry.PVCNamespace != opts.PVCNamespace) {
+			continue
+		}
+		if opts.ResumeSelected {
+			ok, err := isSelected(client, entry, opts, nsLabels)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		selected = append(selected, entry)
+	}
 
-	logger.DefaultLog("Start Migration of PVCs to CSI")
-	for _, pvc := range *pvcs {
-		err = migratePVC(client, pvc, destinationStorageClass, rookNamespace, cephClusterNamespace)
+	if opts.ScaleWorkloads && len(selected) > 0 {
+		var pvcs []v1.PersistentVolumeClaim
+		for _, entry := range selected {
+			pvcs = append(pvcs, *entry.OriginalPVC)
+		}
+		workloads, err := scaleDownWorkloads(client, pvcs)
+		defer restoreWorkloads(client, workloads)
 		if err != nil {
-			return fmt.Errorf("failed to migrate PVC %s : %v", pvc.Name, err)
+			return err
 		}
 	}
-	logger.DefaultLog("Successfully migrated all the PVCs to CSI")
 
-	return err
+	if len(selected) == 0 {
+		logger.DefaultLog("no interrupted migrations found in the journal")
+		return nil
+	}
+
+	j.events = newEventRecorder(client)
+	defer j.events.close()
+	results := make([]pvcResult, len(selected))
+	for i, entry := range selected {
+		results[i] = pvcResult{namespace: entry.PVCNamespace, name: entry.PVCName, uid: entry.PVCUID}
+	}
+	runWorkers(opts.context(), results, opts.Parallelism, opts.ContinueOnError, withProgress(opts, results, func(i int) (*journalEntry, error) {
+		entry := selected[i]
+		logger.DefaultLog("resuming migration of PVC %q from namespace %q after step %s", entry.PVCName, entry.PVCNamespace, entry.Step)
+		return entry, runMigration(client, j, entry, opts)
+	}))
+	reportErr := writeReport(results, start, opts)
+	if err = summarize("resume migration of", results); err != nil {
+		return err
+	}
+	if reportErr != nil {
+		return reportErr
+	}
+	logger.DefaultLog("Successfully resumed %d PVC migrations", len(selected))
+
+	return nil
+}
+
+// isSelected returns true if the migration of the entry is one of the
+// migrations selected by the options. Any destination storageclass matches
+// if it is resolved for every PVC, see AutoDestination. The labels of the namespaces are cached
+// in nsLabels.
+func isSelected(client *k8s.Clientset, entry *journalEntry, opts *Options, nsLabels map[string]map[string]string) (bool, error) {
+	pvc := entry.OriginalPVC
+	if k8sutil.GetStorageClassName(pvc) != opts.SourceStorageClass {
+		return false, nil
+	}
+	if opts.DestinationStorageClass != "" && entry.DestinationStorageClass != opts.DestinationStorageClass {
+		return false, nil
+	}
+	labels, ok := nsLabels[pvc.Namespace]
+	if !ok {
+		var err error
+		labels, err = k8sutil.GetNamespaceLabels(client, pvc.Namespace)
+		if err != nil {
+			return false, fmt.Errorf("failed to get namespace %s: %v", pvc.Namespace, err)
+		}
+		nsLabels[pvc.Namespace] = labels
+	}
+	return opts.Filter.Matches(pvc, labels)
 }
 
-// migratePVC migrates a PVC to CSI.
-func migratePVC(client *k8s.Clientset, pvc v1.PersistentVolumeClaim, destinationStorageClass,
-	rookNamespace, cephClusterNamespace string) error {
+// migratePVC migrates a PVC to CSI. If the journal already holds an entry for
+// the PVC, the migration continues from the last completed step.
+func migratePVC(client *k8s.Clientset, j *journal, pvc v1.PersistentVolumeClaim, opts *Options) (entry *journalEntry, err error) {
 
 	logger.DefaultLog("migrating PVC %q from namespace %q", pvc.Name, pvc.Namespace)
+	// the failures after the creation of the entry are recorded by
+	// runMigration.
+	defer func() {
+		if err != nil && entry == nil {
+			j.events.recordPVC(&pvc, v1.EventTypeWarning, reasonMigrationFailed, "Migration to storageclass %s failed: %v", opts.DestinationStorageClass, err) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
+		}
+	}()
+
+	entry, err = j.get(string(pvc.UID))
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		logger.DefaultLog("found interrupted migration of PVC %q after step %s, resuming", pvc.Name, entry.Step)
+		return entry, runMigration(client, j, entry, opts)
+	}
 
 	logger.DefaultLog("Fetch PV information from PVC %s", pvc.Name)
 	pv, err := k8sutil.GetPV(client, pvc.Spec.VolumeName)
 	if err != nil {
-		return fmt.Errorf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err)
+		return nil, fmt.Errorf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err)
 	}
 	logger.DefaultLog("PV found %q ", pv.Name)
 
-	// retrieve and validate the volume name before starting the migration
-	logger.DefaultLog("Retrieving old ceph volume name from PV object: %s", pv.Name)
-	rbdImageName := k8sutil.GetVolumeName(pv)
-	if rbdImageName == "" {
-		return fmt.Errorf("rbdImageName cannot be empty in PV object: %v", pv)
+	mode := modeRename
+	if opts.Static {
+		mode = modeStatic
+	}
+	var sourceName, sourcePool, fsName string
+	var crossCluster bool
+	if k8sutil.IsCephFSVolume(pv) {
+		mode = modeCephFS
+		sourceName = k8sutil.GetCephFSPath(pv)
+		logger.DefaultLog("CephFS share path is %q ", sourceName)
+		fsName, err = resolveCephFSName(client, pv, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// retrieve and validate the volume name before starting the migration
+		logger.DefaultLog("Retrieving old ceph volume name from PV object: %s", pv.Name)
+		sourceName = k8sutil.GetVolumeName(pv)
+		if sourceName == "" {
+			return nil, fmt.Errorf("rbdImageName cannot be empty in PV object: %v", pv)
+		}
+		logger.DefaultLog("rbd image name is %q ", sourceName)
+		crossCluster, err = isCrossCluster(client, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !crossCluster {
+			sourcePool, err = checkSourcePool(client, pv, sourceName, mode, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if sourcePool != "" {
+			mode = modeCrossPool
+		}
 	}
-	logger.DefaultLog("rbd image name is %q ", rbdImageName)
 
-	logger.DefaultLog("Update Reclaim policy from Delete to Reclaim for PV: %s", pv.Name)
-	err = k8sutil.UpdateReclaimPolicy(client, pv)
+	err = preflightCheck(client, &pvc, pv, sourceName, opts) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
 	if err != nil {
-		return fmt.Errorf("failed to update ReclaimPolicy for PV object %s: %v", pvc.Spec.VolumeName, err)
+		return nil, err
 	}
 
-	logger.DefaultLog("Deleting pvc object: %s", pvc.Name)
-	err = k8sutil.DeletePVC(client, &pvc) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
+	if crossCluster {
+		entry, err = newCrossClusterEntry(client, &pvc, pv, sourceName, opts) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		entry = newJournalEntry(&pvc, pv, sourceName, opts.DestinationStorageClass, mode) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
+		entry.FSName = fsName
+		entry.SourcePool = sourcePool
+	}
+	err = j.checkpoint(entry, stepStarted)
 	if err != nil {
-		return fmt.Errorf("failed to Delete PVC object %s: %v", pvc.Name, err)
+		return nil, err
 	}
 
-	logger.DefaultLog("Generate new PVC with same name in destination storageclass")
-	csiPVC := k8sutil.GenerateCSIPVC(destinationStorageClass, &pvc) // nolint:gosec // skip gosec as pvc is accessed via it's reference.
+	return entry, runMigration(client, j, entry, opts)
+}
 
-	logger.DefaultLog("Create new csi pvc")
-	csiPV, err := k8sutil.CreatePVC(client, csiPVC, pvcCreateTimeout)
+// runMigration runs the migration of the journal entry and records its start
+// and its outcome as events.
+func runMigration(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+	if entry.Step == stepStarted {
+		j.events.record(entry, v1.EventTypeNormal, reasonMigrationStarted, "Migration of PVC %s/%s to storageclass %s started",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass)
+	} else {
+		j.events.record(entry, v1.EventTypeNormal, reasonMigrationStarted, "Migration of PVC %s/%s to storageclass %s resumed after step %s",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass, entry.Step)
+	}
+	err := runSteps(client, j, entry, opts)
 	if err != nil {
-		return fmt.Errorf("failed to Create CSI PVC object %s: %v", pvc.Name, err)
+		j.events.record(entry, v1.EventTypeWarning, reasonMigrationFailed, "Migration of PVC %s/%s to storageclass %s failed after step %s: %v",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass, entry.Step, err)
+		return err
 	}
-	logger.DefaultLog("New PVC with same name %q created via CSI", csiPVC.Name)
+	j.events.record(entry, v1.EventTypeNormal, reasonMigrationSucceeded, "PVC %s/%s migrated to storageclass %s",
+		entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass)
+	return nil
+}
+
+// runSteps runs every step of the migration which isn't recorded as
+// completed in the journal entry. Each step is idempotent so that a step which
+// was interrupted before being recorded can safely be run again.
+func runSteps(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+	var err error
 
-	logger.DefaultLog("Extracting new volume name from CSI PV")
-	csiRBDImageName := k8sutil.WaitForRBDImage(csiPV)
-	if csiRBDImageName == "" {
-		return fmt.Errorf("csiRBDImageName cannot be empty in PV object %v", csiPV)
+	if entry.Mode == modeCrossCluster && !entry.reached(stepImageSynced) {
+		if err = syncImage(client, j, entry, opts, false); err != nil {
+			return err
+		}
 	}
-	logger.DefaultLog("CSI new volume name: %v ", csiRBDImageName)
 
-	logger.DefaultLog("Fetching csi pool name")
-	poolName := k8sutil.GetCSIPoolName(csiPV)
-	if poolName == "" {
-		return fmt.Errorf("poolName cannot be empty in PV object")
+	if entry.stepIndex(stepSnapshotCreated) >= 0 && !entry.reached(stepSnapshotCreated) {
+		if err = createPreMigrationSnapshot(client, j, entry, opts); err != nil {
+			return err
+		}
 	}
-	logger.DefaultLog("csi poolname: %v ", poolName)
 
-	logger.DefaultLog("Create new Ceph connection")
-	conn, err := createClusterConnection(client, csiPV, rookNamespace, cephClusterNamespace)
+	if !entry.reached(stepReclaimPolicyRetained) {
+		logger.DefaultLog("Update Reclaim policy from Delete to Reclaim for PV: %s", entry.PVName)
+		pv, err := k8sutil.GetPV(client, entry.PVName)
+		if err != nil {
+			return fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+		}
+		if err = j.backupPV(entry, pv); err != nil {
+			return err
+		}
+		err = k8sutil.UpdateReclaimPolicy(client, pv)
+		if err != nil {
+			return fmt.Errorf("failed to update ReclaimPolicy for PV object %s: %v", entry.PVName, err)
+		}
+		if err = j.checkpoint(entry, stepReclaimPolicyRetained); err != nil {
+			return err
+		}
+	}
+
+	if !entry.reached(stepPVCDeleted) {
+		logger.DefaultLog("Deleting pvc object: %s", entry.PVCName)
+		pvc, err := k8sutil.GetPVC(client, entry.PVCName, entry.PVCNamespace)
+		switch {
+		case apierrs.IsNotFound(err):
+			logger.DefaultLog("PVC %s is already deleted", entry.PVCName)
+		case err != nil:
+			return fmt.Errorf("failed to get PVC object %s: %v", entry.PVCName, err)
+		case string(pvc.UID) != entry.PVCUID:
+			logger.DefaultLog("PVC %s was already replaced", entry.PVCName)
+		default:
+			if err = j.backupPVC(entry, pvc); err != nil {
+				return err
+			}
+			deleteStart := time.Now()
+			err = k8sutil.DeletePVC(client, pvc)
+			metrics.ObserveDuration(metrics.OperationDeletePVC, deleteStart)
+			if err != nil {
+				return fmt.Errorf("failed to Delete PVC object %s: %v", entry.PVCName, err)
+			}
+		}
+		if err = j.checkpoint(entry, stepPVCDeleted); err != nil {
+			return err
+		}
+	}
+
+	if entry.Mode == modeCrossCluster && !entry.reached(stepImageFinalSynced) {
+		if err = syncImage(client, j, entry, opts, true); err != nil {
+			return err
+		}
+	}
+
+	if entry.isStatic() {
+		err = importStaticPV(client, j, entry, opts)
+	} else {
+		err = renameCSIImage(client, j, entry, opts)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get cluster config %v", err)
+		return err
 	}
-	defer func() {
-		err = rbd.RemoveKeyDir()
+
+	if err = j.remove(entry.PVCUID); err != nil {
+		logger.ErrorLog("failed to remove PVC %s from the journal: %v", entry.PVCName, err)
+	}
+	// the manifests describe objects replaced by the migration, they are
+	// only restored on demand.
+	if err = j.backups.Complete(entry.backupGroup()); err != nil {
+		logger.ErrorLog("failed to mark the backup of PVC %s completed: %v", entry.PVCName, err)
+	}
+	logger.DefaultLog("successfully migrated pvc %s", entry.PVCName)
+	return nil
+}
+
+// renameCSIImage provisions a volume in the destination storageclass, removes
+// its placeholder image and renames the old image to the placeholder name.
+func renameCSIImage(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+	if !entry.reached(stepCSIPVCCreated) {
+		csiPV, err := createCSIPVC(client, entry, opts)
 		if err != nil {
-			logger.ErrorLog("failed to destroy the connection: %v", err)
+			return err
 		}
-	}()
-	logger.DefaultLog("Cluster connection created")
+		logger.DefaultLog("New PVC with same name %q created via CSI", entry.PVCName)
 
-	logger.DefaultLog("Delete the placeholder CSI volume in ceph cluster")
-	err = conn.RemoveVolumeAdmin(poolName, csiRBDImageName)
-	if err != nil {
-		return fmt.Errorf("failed to delete the CSI volume in ceph cluster: %v", err)
+		logger.DefaultLog("Extracting new volume name from CSI PV")
+		csiRBDImageName := k8sutil.WaitForRBDImage(csiPV)
+		if csiRBDImageName == "" {
+			return fmt.Errorf("csiRBDImageName cannot be empty in PV object %v", csiPV)
+		}
+		logger.DefaultLog("CSI new volume name: %v ", csiRBDImageName)
+
+		logger.DefaultLog("Fetching csi pool name")
+		poolName := k8sutil.GetCSIPoolName(csiPV)
+		if poolName == "" {
+			return fmt.Errorf("poolName cannot be empty in PV object")
+		}
+		logger.DefaultLog("csi poolname: %v ", poolName)
+
+		clusterID := k8sutil.GetClusterID(csiPV)
+		if clusterID == "" {
+			return fmt.Errorf("clusterID cannot be empty in PV object")
+		}
+
+		entry.CSIPVName = csiPV.Name
+		entry.CSIImage = csiRBDImageName
+		entry.Pool = poolName
+		entry.ClusterID = clusterID
+		if err = j.checkpoint(entry, stepCSIPVCCreated); err != nil {
+			return err
+		}
 	}
-	logger.DefaultLog("Successfully removed volume %s", csiRBDImageName)
 
-	logger.DefaultLog("Rename old ceph volume to new CSI volume")
-	err = conn.RenameVolume(csiRBDImageName, rbdImageName)
+	if !entry.reached(stepImageRenamed) && !entry.reached(stepMigrationCommitted) {
+		logger.DefaultLog("Create new Ceph connection")
+		conn, err := createClusterConnection(client, entry.Pool, entry.ClusterID, opts)
+		if err != nil {
+			return fmt.Errorf("failed to get cluster config %v", err)
+		}
+		defer closeConnection(conn)
+		logger.DefaultLog("Cluster connection created")
+
+		if !entry.reached(stepPlaceholderRemoved) {
+			logger.DefaultLog("Move the placeholder CSI volume to the trash in ceph cluster")
+			trashStart := time.Now()
+			err = trashPlaceholder(j, conn, entry, opts.TrashDelay)
+			metrics.ObserveDuration(metrics.OperationMoveToTrash, trashStart)
+			if err != nil {
+				return err
+			}
+			if err = j.checkpoint(entry, stepPlaceholderRemoved); err != nil {
+				return err
+			}
+		}
+
+		if entry.Mode == modeCrossPool {
+			if err = moveImage(client, j, entry, conn, opts); err != nil {
+				return err
+			}
+		} else {
+			logger.DefaultLog("Rename old ceph volume to new CSI volume")
+			renamed, err := isImageRenamed(conn, entry)
+			if err != nil {
+				return err
+			}
+			if !renamed {
+				renameStart := time.Now()
+				err = conn.RenameVolume(entry.CSIImage, entry.SourceImage)
+				metrics.ObserveDuration(metrics.OperationRenameVolume, renameStart)
+				if err != nil {
+					return fmt.Errorf("failed to rename old ceph volume %s to new CSI volume %s: %v", entry.SourceImage, entry.CSIImage, err)
+				}
+			}
+			logger.DefaultLog("successfully renamed volume %s -> %s", entry.CSIImage, entry.SourceImage)
+			if err = j.checkpoint(entry, stepImageRenamed); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !entry.reached(stepPVDeleted) {
+		err := deleteOldPV(client, entry)
+		if err != nil {
+			return err
+		}
+		if err = j.checkpoint(entry, stepPVDeleted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importStaticPV replaces the old PV by a static CSI PV which points to the
+// old image, or to the path of the old CephFS share, and binds the recreated
+// PVC to it. No image or share is removed or renamed.
+func importStaticPV(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+	if !entry.reached(stepPVDeleted) {
+		err := deleteOldPV(client, entry)
+		if err != nil {
+			return err
+		}
+		if err = j.checkpoint(entry, stepPVDeleted); err != nil {
+			return err
+		}
+	}
+
+	if !entry.reached(stepStaticPVCreated) {
+		dest, err := resolveDestination(client, entry.DestinationStorageClass, opts)
+		if err != nil {
+			return err
+		}
+		sc, err := k8sutil.GetStorageClass(client, entry.DestinationStorageClass)
+		if err != nil {
+			return fmt.Errorf("failed to get destination StorageClass %s: %v", entry.DestinationStorageClass, err)
+		}
+		var pool string
+		var staticPV *v1.PersistentVolume
+		if entry.Mode == modeCephFS {
+			logger.DefaultLog("Create static CephFS CSI PV %s for path %s of file system %s", entry.PVName, entry.SourceImage, entry.FSName)
+			staticPV = k8sutil.GenerateStaticCephFSPV(sc, entry.OriginalPV, dest.ClusterID, entry.FSName, entry.SourceImage)
+		} else {
+			pool = k8sutil.GetVolumePool(entry.OriginalPV)
+			if pool == "" {
+				pool = dest.Pool
+			}
+			logger.DefaultLog("Create static CSI PV %s for rbd image %s in pool %s", entry.PVName, entry.SourceImage, pool)
+			staticPV = k8sutil.GenerateStaticCSIPV(sc, entry.OriginalPV, pool, dest.ClusterID, entry.SourceImage)
+		}
+
+		_, err = k8sutil.GetPV(client, entry.PVName)
+		switch {
+		case apierrs.IsNotFound(err):
+			_, err = k8sutil.CreatePV(client, staticPV)
+			if err != nil {
+				return fmt.Errorf("failed to create static CSI PV %s: %v", entry.PVName, err)
+			}
+		case err != nil:
+			return fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+		default:
+			logger.DefaultLog("static CSI PV %s already exists", entry.PVName)
+		}
+
+		entry.CSIPVName = entry.PVName
+		entry.CSIImage = entry.SourceImage
+		entry.Pool = pool
+		entry.ClusterID = dest.ClusterID
+		if err = j.checkpoint(entry, stepStaticPVCreated); err != nil {
+			return err
+		}
+	}
+
+	if !entry.reached(stepCSIPVCCreated) {
+		_, err := createCSIPVC(client, entry, opts)
+		if err != nil {
+			return err
+		}
+		logger.DefaultLog("New PVC with same name %q bound to static CSI PV %s", entry.PVCName, entry.CSIPVName)
+		if err = j.checkpoint(entry, stepCSIPVCCreated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOldPV deletes the PV the original PVC was bound to.
+func deleteOldPV(client *k8s.Clientset, entry *journalEntry) error {
+	logger.DefaultLog("Delete old PV object: %s", entry.PVName)
+	pv, err := k8sutil.GetPV(client, entry.PVName)
+	switch {
+	case apierrs.IsNotFound(err):
+		logger.DefaultLog("persistent volume %s is already deleted", entry.PVName)
+	case err != nil:
+		return fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+	case pv.UID != entry.OriginalPV.UID:
+		logger.DefaultLog("persistent volume %s was already replaced", entry.PVName)
+	default:
+		start := time.Now()
+		err = k8sutil.DeletePV(client, pv)
+		metrics.ObserveDuration(metrics.OperationDeletePV, start)
+		if err != nil {
+			return fmt.Errorf("failed to delete persistent volume %s: %v", entry.PVName, err)
+		}
+	}
+	logger.DefaultLog("deleted persistent volume %s", entry.PVName)
+	return nil
+}
+
+// createCSIPVC creates the PVC in the destination storageclass, or waits for
+// the one created before the migration was interrupted to be bound.
+func createCSIPVC(client *k8s.Clientset, entry *journalEntry, opts *Options) (*v1.PersistentVolume, error) {
+	pvc, err := k8sutil.GetPVC(client, entry.PVCName, entry.PVCNamespace)
+	if err == nil && string(pvc.UID) != entry.PVCUID {
+		logger.DefaultLog("CSI PVC %s already exists, waiting for it to be bound", entry.PVCName)
+		entry.MetadataChanges = k8sutil.MetadataChanges(&entry.OriginalPVC.ObjectMeta, &pvc.ObjectMeta)
+		pv, err := k8sutil.WaitForBoundPV(client, pvc, pvcCreateTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for CSI PVC object %s: %v", entry.PVCName, err)
+		}
+		return pv, nil
+	}
+	if err != nil && !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get PVC object %s: %v", entry.PVCName, err)
+	}
+
+	logger.DefaultLog("Generate new PVC with same name in destination storageclass")
+	csiPVC := k8sutil.GenerateCSIPVC(entry.DestinationStorageClass, entry.OriginalPVC, &opts.MetadataPolicy)
+	if entry.isStatic() {
+		csiPVC.Spec.VolumeName = entry.CSIPVName
+	}
+	if entry.Snapshot != "" {
+		csiPVC.Annotations[annPreMigrationSnapshot] = entry.Snapshot
+	}
+	entry.MetadataChanges = k8sutil.MetadataChanges(&entry.OriginalPVC.ObjectMeta, &csiPVC.ObjectMeta)
+	for _, change := range entry.MetadataChanges {
+		logger.DefaultLog("PVC %s: %s", entry.PVCName, change)
+	}
+
+	logger.DefaultLog("Create new csi pvc")
+	start := time.Now()
+	pv, err := k8sutil.CreatePVC(client, csiPVC, pvcCreateTimeout)
+	metrics.ObserveDuration(metrics.OperationCreatePVC, start)
 	if err != nil {
-		return fmt.Errorf("failed to rename old ceph volume %s to new CSI volume %s: %v", rbdImageName, csiRBDImageName, err)
+		return nil, fmt.Errorf("failed to Create CSI PVC object %s: %v", entry.PVCName, err)
 	}
-	logger.DefaultLog("successfully renamed volume %s -> %s", csiRBDImageName, rbdImageName)
+	return pv, nil
+}
 
-	logger.DefaultLog("Delete old PV object: %s", pv.Name)
-	err = k8sutil.DeletePV(client, pv)
+// isImageRenamed checks if the old ceph volume was already renamed to the CSI
+// volume name.
+func isImageRenamed(conn *rbd.Connection, entry *journalEntry) (bool, error) {
+	sourceExists, err := conn.ImageExists(entry.SourceImage)
 	if err != nil {
-		return fmt.Errorf("failed to delete persistent volume %s: %v", pv.Name, err)
+		return false, fmt.Errorf("failed to check old ceph volume %s: %v", entry.SourceImage, err)
 	}
-	logger.DefaultLog("deleted persistent volume %s", pv.Name)
-	logger.DefaultLog("successfully migrated pvc %s", pvc.Name)
-	return nil
+	if sourceExists {
+		return false, nil
+	}
+	csiExists, err := conn.ImageExists(entry.CSIImage)
+	if err != nil {
+		return false, fmt.Errorf("failed to check CSI volume %s: %v", entry.CSIImage, err)
+	}
+	if !csiExists {
+		return false, fmt.Errorf("neither old ceph volume %s nor CSI volume %s exists", entry.SourceImage, entry.CSIImage)
+	}
+	return true, nil
 }
@@ -0,0 +1,241 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// pvcPlan holds the operations the migration of a PVC would run, and the
+// preconditions of the migration which aren't met.
+type pvcPlan struct {
+	pvc        *v1.PersistentVolumeClaim
+	resumeFrom migrationStep
+	operations []string
+	problems   []string
+}
+
+// planMigration prints the ordered list of operations the migration of every
+// PVC would run, without changing anything. It returns an error if any
+// precondition of the migration isn't met.
+func planMigration(client *k8s.Clientset, j *journal, pvcs []v1.PersistentVolumeClaim, opts *Options) error {
+	logger.DefaultLog("Dry run: planning the migration of %d PVCs", len(pvcs))
+	w := os.Stdout
+
+	var globalProblems []string
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		globalProblems = append(globalProblems, err.Error())
+	}
+	user, _, err := rbdCredentials(client, opts)
+	if err != nil {
+		globalProblems = append(globalProblems, fmt.Sprintf("failed to get the CSI provisioner credentials: %v", err))
+	}
+	var workloads []k8sutil.Workload
+	if opts.ScaleWorkloads {
+		workloads, err = k8sutil.ListWorkloadsUsingPVCs(client, pvcs)
+		if err != nil {
+			globalProblems = append(globalProblems, err.Error())
+		}
+	}
+
+	fmt.Fprintf(w, "Destination StorageClass %s: pool %q, clusterID %q, monitors %q, ceph user %q\n",
+		opts.DestinationStorageClass, dest.Pool, dest.ClusterID, dest.Monitors, user)
+	for _, problem := range globalProblems {
+		fmt.Fprintf(w, "  precondition failed: %s\n", problem)
+	}
+	for _, workload := range workloads {
+		fmt.Fprintf(w, "Scale down %s during the migration\n", workload)
+	}
+
+	failed := 0
+	for i := range pvcs {
+		plan := planPVC(client, j, &pvcs[i], dest, user, opts)
+		plan.print(w)
+		if len(plan.problems) > 0 || len(globalProblems) > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d PVCs would fail to migrate", failed, len(pvcs))
+	}
+	logger.DefaultLog("Dry run: all the preconditions are met for %d PVCs", len(pvcs))
+	return nil
+}
+
+// planPVC resolves the objects and images involved in the migration of the
+// PVC and lists the operations which would be run for it.
+func planPVC(client *k8s.Clientset, j *journal, pvc *v1.PersistentVolumeClaim, dest *destination, user string, opts *Options) *pvcPlan {
+	plan := &pvcPlan{pvc: pvc}
+
+	entry, err := j.get(string(pvc.UID))
+	if err != nil {
+		plan.problems = append(plan.problems, err.Error())
+		return plan
+	}
+	if entry != nil {
+		plan.resumeFrom = entry.Step
+	} else {
+		if pvc.Spec.VolumeName == "" {
+			plan.problems = append(plan.problems, "PVC is not bound to a PV")
+			return plan
+		}
+		pv, err := k8sutil.GetPV(client, pvc.Spec.VolumeName)
+		if err != nil {
+			plan.problems = append(plan.problems, fmt.Sprintf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err))
+			return plan
+		}
+		mode := modeRename
+		if opts.Static {
+			mode = modeStatic
+		}
+		var sourceName, fsName, pool string
+		if k8sutil.IsCephFSVolume(pv) {
+			mode = modeCephFS
+			sourceName = k8sutil.GetCephFSPath(pv)
+			fsName = k8sutil.GetCephFSName(pv)
+			if fsName == "" {
+				fsName = dest.FSName
+			}
+			if dest.FSName == "" {
+				plan.problems = append(plan.problems, fmt.Sprintf("PV %s is a CephFS volume but destination StorageClass has no fsName parameter", pv.Name))
+			}
+		} else {
+			sourceName = k8sutil.GetVolumeName(pv)
+			if sourceName == "" {
+				plan.problems = append(plan.problems, fmt.Sprintf("rbd image name cannot be found in PV object %s", pv.Name))
+				return plan
+			}
+			pool = k8sutil.GetVolumePool(pv)
+			if opts.SourceClusterID != "" && opts.SourceClusterID != dest.ClusterID {
+				if opts.Static {
+					plan.problems = append(plan.problems, fmt.Sprintf("static migration of PVC %s is not supported across clusters", pvc.Name))
+				}
+				mode = modeCrossCluster
+			} else if mode == modeRename && pool != "" && dest.Pool != "" && pool != dest.Pool {
+				if opts.CrossPool {
+					mode = modeCrossPool
+				} else {
+					plan.problems = append(plan.problems, fmt.Sprintf("rbd image %s is in pool %s but destination StorageClass uses pool %s, use --cross-pool to move it", sourceName, pool, dest.Pool))
+				}
+			}
+		}
+		if !opts.Force && !opts.ScaleWorkloads {
+			if err = checkVolumeInUse(client, nil, pvc, pv, "", sourceName); err != nil {
+				plan.problems = append(plan.problems, err.Error())
+			}
+		}
+		entry = newJournalEntry(pvc, pv, sourceName, dest.StorageClass, mode)
+		entry.Step = stepStarted
+		entry.FSName = fsName
+		if mode == modeStatic {
+			entry.Pool = pool
+		}
+		if mode == modeCrossPool {
+			entry.SourcePool = pool
+		}
+		if mode == modeCrossCluster {
+			entry.SourcePool = pool
+			entry.SourceClusterID = opts.SourceClusterID
+			entry.Pool = dest.Pool
+		}
+	}
+
+	csiImage := entry.CSIImage
+	if csiImage == "" {
+		csiImage = "<csi-image>"
+	}
+	pool := entry.Pool
+	if pool == "" {
+		pool = dest.Pool
+	}
+	sourcePool := entry.SourcePool
+	if sourcePool == "" {
+		sourcePool = k8sutil.GetVolumePool(entry.OriginalPV)
+	}
+	if sourcePool == "" {
+		sourcePool = dest.Pool
+	}
+	operations := map[migrationStep]string{
+		stepReclaimPolicyRetained: fmt.Sprintf("update reclaim policy of PV %s from %s to %s", entry.PVName,
+			entry.OriginalPV.Spec.PersistentVolumeReclaimPolicy, v1.PersistentVolumeReclaimRetain),
+		stepSnapshotCreated: fmt.Sprintf("rbd snap create %s/%s@%s<timestamp> --id %s -m %s", sourcePool, entry.SourceImage,
+			preMigrationSnapshotPrefix, user, dest.Monitors),
+		stepPVCDeleted: fmt.Sprintf("delete PVC %s/%s", entry.PVCNamespace, entry.PVCName),
+		stepCSIPVCCreated: fmt.Sprintf("create PVC %s/%s in StorageClass %s and wait for %s to be provisioned",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass, csiImage),
+		stepPlaceholderRemoved: fmt.Sprintf("rbd rename %s %s%s --pool %s -m %s && rbd trash mv %s/%s%s --expires-at <now+%v>",
+			csiImage, trashPrefix, csiImage, pool, dest.Monitors, pool, trashPrefix, csiImage, opts.TrashDelay),
+		stepImageRenamed: fmt.Sprintf("rbd rename %s %s --pool %s --id %s -m %s", entry.SourceImage, csiImage,
+			pool, user, dest.Monitors),
+		stepPVDeleted: fmt.Sprintf("delete PV %s", entry.PVName),
+		stepMigrationPrepared: fmt.Sprintf("rbd migration prepare %s/%s %s/%s --id %s -m %s", entry.SourcePool, entry.SourceImage,
+			pool, csiImage, user, dest.Monitors),
+		stepMigrationExecuted:  fmt.Sprintf("rbd migration execute %s/%s --id %s -m %s", pool, csiImage, user, dest.Monitors),
+		stepMigrationCommitted: fmt.Sprintf("rbd migration commit %s/%s --id %s -m %s", pool, csiImage, user, dest.Monitors),
+		stepImageSynced: fmt.Sprintf("rbd export-diff %s/%s@%s<n> from cluster %s | rbd import-diff to %s/%s in cluster %s",
+			entry.SourcePool, entry.SourceImage, syncSnapshotPrefix, entry.SourceClusterID, pool, entry.SourceImage, dest.ClusterID),
+		stepImageFinalSynced: fmt.Sprintf("rbd export-diff of the last changes of %s/%s | rbd import-diff to %s/%s, and remove the %s snapshots",
+			entry.SourcePool, entry.SourceImage, pool, entry.SourceImage, syncSnapshotPrefix),
+	}
+	if entry.isStatic() {
+		operations[stepStaticPVCreated] = fmt.Sprintf("create static CSI PV %s for rbd image %s in pool %s of cluster %s",
+			entry.PVName, entry.SourceImage, pool, dest.ClusterID)
+		operations[stepCSIPVCCreated] = fmt.Sprintf("create PVC %s/%s in StorageClass %s bound to PV %s",
+			entry.PVCNamespace, entry.PVCName, entry.DestinationStorageClass, entry.PVName)
+	}
+	if entry.Mode == modeCephFS {
+		operations[stepStaticPVCreated] = fmt.Sprintf("create static CephFS CSI PV %s for path %s of file system %s in cluster %s",
+			entry.PVName, entry.SourceImage, entry.FSName, dest.ClusterID)
+	}
+	if !entry.reached(stepCSIPVCCreated) {
+		csiPVC := k8sutil.GenerateCSIPVC(entry.DestinationStorageClass, entry.OriginalPVC, &opts.MetadataPolicy)
+		changes := k8sutil.MetadataChanges(&entry.OriginalPVC.ObjectMeta, &csiPVC.ObjectMeta)
+		if len(changes) > 0 {
+			operations[stepCSIPVCCreated] += " (" + strings.Join(changes, ", ") + ")"
+		}
+	}
+	for _, step := range entry.steps() {
+		if op, ok := operations[step]; ok && !entry.reached(step) {
+			plan.operations = append(plan.operations, op)
+		}
+	}
+	return plan
+}
+
+func (p *pvcPlan) print(w io.Writer) {
+	fmt.Fprintf(w, "PVC %s/%s:\n", p.pvc.Namespace, p.pvc.Name)
+	if p.resumeFrom != "" {
+		fmt.Fprintf(w, "  resume interrupted migration after step %s\n", p.resumeFrom)
+	}
+	for i, op := range p.operations {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, op)
+	}
+	for _, problem := range p.problems {
+		fmt.Fprintf(w, "  precondition failed: %s\n", problem)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"strings"
+
+	"persistent-volume-migrator/pkg/ceph/rbd"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// checkVolumeInUse returns an error if the volume of the PVC is still in use:
+// mounted by a pod, attached to a node or watched by an rbd client. The rbd
+// watchers are only checked when conn is set.
+func checkVolumeInUse(client *k8s.Clientset, conn *rbd.Connection, pvc *v1.PersistentVolumeClaim,
+	pv *v1.PersistentVolume, pool, imageName string) error {
+	var reasons []string
+
+	pods, err := k8sutil.ListPodsUsingPVC(client, pvc)
+	if err != nil {
+		return fmt.Errorf("failed to list pods using PVC %s: %v", pvc.Name, err)
+	}
+	for _, pod := range pods {
+		reasons = append(reasons, fmt.Sprintf("mounted by pod %s/%s", pod.Namespace, pod.Name))
+	}
+
+	attachments, err := k8sutil.ListVolumeAttachments(client, pv.Name)
+	if err != nil {
+		return fmt.Errorf("failed to list VolumeAttachments of PV %s: %v", pv.Name, err)
+	}
+	for _, va := range attachments {
+		reasons = append(reasons, fmt.Sprintf("attached to node %s by VolumeAttachment %s", va.Spec.NodeName, va.Name))
+	}
+
+	if conn != nil {
+		watchers, err := conn.ListWatchers(pool, imageName)
+		if err != nil {
+			return fmt.Errorf("failed to list watchers of rbd image %s/%s: %v", pool, imageName, err)
+		}
+		for _, w := range watchers {
+			reasons = append(reasons, fmt.Sprintf("rbd image %s/%s watched by %s", pool, imageName, w.Address))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return fmt.Errorf("volume of PVC %s/%s is still in use: %s", pvc.Namespace, pvc.Name, strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// preflightCheck makes sure the volume of the PVC can be migrated before any
+// change is made to the PVC or its PV.
+func preflightCheck(client *k8s.Clientset, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume,
+	imageName string, opts *Options) error {
+	if opts.Force {
+		logger.DefaultLog("skipping in-use check of PVC %s as the migration is forced", pvc.Name)
+		return nil
+	}
+
+	logger.DefaultLog("Checking that the volume of PVC %s is not in use", pvc.Name)
+	if k8sutil.IsCephFSVolume(pv) {
+		// CephFS shares have no rbd watchers.
+		return checkVolumeInUse(client, nil, pvc, pv, "", imageName)
+	}
+
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return err
+	}
+	pool := k8sutil.GetVolumePool(pv)
+	if pool == "" {
+		pool = dest.Pool
+	}
+	clusterID, connOpts := dest.ClusterID, opts
+	if opts.SourceClusterID != "" {
+		clusterID, connOpts = opts.SourceClusterID, sourceOptions(opts)
+	}
+	conn, err := createClusterConnection(client, pool, clusterID, connOpts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+
+	return checkVolumeInUse(client, conn, pvc, pv, pool, imageName)
+}
@@ -0,0 +1,372 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// csiPVDeleteTimeout is the time given to the CSI provisioner to delete a
+	// PV and its placeholder image once the CSI PVC is deleted.
+	csiPVDeleteTimeout = 5 * time.Minute
+
+	annBindCompleted      = "pv.kubernetes.io/bind-completed"
+	annBoundByController  = "pv.kubernetes.io/bound-by-controller"
+	annStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
+)
+
+// RollbackMigration restores the original PVC and PV of the migrations
+// recorded in the journal which did not complete. If PVCName and PVCNamespace
+// are set, only the migration of that PVC is rolled back.
+func RollbackMigration(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	j := newJournal(client, opts)
+	entries, err := j.list()
+	if err != nil {
+		return err
+	}
+
+	rolledBack := 0
+	for _, entry := range entries {
+		if opts.PVCName != "" && opts.PVCNamespace != "" && (entry.PVCName != opts.PVCName || entry.PVCNamespace != opts.PVCNamespace) {
+			continue
+		}
+		if err = opts.context().Err(); err != nil {
+			return fmt.Errorf("rollback interrupted after %d PVCs: %v", rolledBack, err)
+		}
+		logger.DefaultLog("rolling back migration of PVC %q from namespace %q after step %s", entry.PVCName, entry.PVCNamespace, entry.Step)
+		err = rollbackPVC(client, j, entry, opts)
+		if err != nil {
+			return fmt.Errorf("failed to rollback migration of PVC %s : %v", entry.PVCName, err)
+		}
+		rolledBack++
+	}
+	if rolledBack == 0 {
+		logger.DefaultLog("no interrupted migrations found in the journal")
+		return nil
+	}
+	logger.DefaultLog("Successfully rolled back %d PVC migrations", rolledBack)
+
+	return nil
+}
+
+// rollbackPVC undoes the steps of a migration recorded in the journal entry.
+// It can safely be run again if it is interrupted.
+func rollbackPVC(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+
+	// the live migration is aborted first, as it can't be once committed.
+	if entry.Mode == modeCrossPool && entry.reached(stepPlaceholderRemoved) {
+		err := abortMove(client, entry, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if entry.reached(stepPVCDeleted) {
+		err := removeCSIPVC(client, j, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the placeholder image is deleted along with the CSI PV under its CSI
+	// name, but not once renamed for the trash.
+	if entry.TrashImage != "" && !entry.reached(stepPlaceholderRemoved) {
+		err := trashRenamedPlaceholder(client, entry, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if entry.reached(stepPlaceholderRemoved) && entry.Mode != modeCrossPool {
+		logger.DefaultLog("Create new Ceph connection")
+		conn, err := createClusterConnection(client, entry.Pool, entry.ClusterID, opts)
+		if err != nil {
+			return fmt.Errorf("failed to get cluster config %v", err)
+		}
+		defer closeConnection(conn)
+
+		renamed, err := isImageRenamed(conn, entry)
+		if err != nil {
+			return err
+		}
+		if renamed {
+			logger.DefaultLog("Rename CSI volume %s back to old ceph volume %s", entry.CSIImage, entry.SourceImage)
+			err = conn.RenameVolume(entry.SourceImage, entry.CSIImage)
+			if err != nil {
+				return fmt.Errorf("failed to rename CSI volume %s to old ceph volume %s: %v", entry.CSIImage, entry.SourceImage, err)
+			}
+		}
+	}
+
+	if entry.Mode == modeCrossCluster {
+		err := removeCrossClusterCopy(client, entry, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if entry.Snapshot != "" && !entry.reached(stepPVCDeleted) {
+		// the PVC wasn't touched, so the snapshot of its image isn't needed.
+		err := removeSourceSnapshot(client, entry, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	pv, err := restorePV(client, entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.reached(stepPVCDeleted) {
+		err = restorePVC(client, entry)
+		if err != nil {
+			return err
+		}
+		// re-get the PV as it was updated when it was bound to the PVC.
+		pv, err = k8sutil.GetPV(client, entry.PVName)
+		if err != nil {
+			return fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+		}
+	}
+
+	logger.DefaultLog("Restore Reclaim policy %s for PV: %s", entry.OriginalPV.Spec.PersistentVolumeReclaimPolicy, pv.Name)
+	pv.Spec.PersistentVolumeReclaimPolicy = entry.OriginalPV.Spec.PersistentVolumeReclaimPolicy
+	err = k8sutil.UpdatePV(client, pv)
+	if err != nil {
+		return fmt.Errorf("failed to restore ReclaimPolicy for PV object %s: %v", pv.Name, err)
+	}
+
+	if err = j.remove(entry.PVCUID); err != nil {
+		return fmt.Errorf("failed to remove PVC %s from the journal: %v", entry.PVCName, err)
+	}
+	logger.DefaultLog("successfully rolled back pvc %s", entry.PVCName)
+	return nil
+}
+
+// trashRenamedPlaceholder moves to the trash the placeholder image of the
+// entry if it was renamed before the migration was interrupted.
+func trashRenamedPlaceholder(client *k8s.Clientset, entry *journalEntry, opts *Options) error {
+	conn, err := createClusterConnection(client, entry.Pool, entry.ClusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	return moveRenamedPlaceholder(conn, entry, opts.TrashDelay)
+}
+
+// removeCSIPVC deletes the PVC and PV created in the destination storageclass.
+// The CSI PV is retained once the placeholder image was removed, so that
+// deleting it never touches the renamed image.
+func removeCSIPVC(client *k8s.Clientset, j *journal, entry *journalEntry) error {
+	csiPVName := entry.CSIPVName
+	pvc, err := k8sutil.GetPVC(client, entry.PVCName, entry.PVCNamespace)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to get PVC object %s: %v", entry.PVCName, err)
+	}
+	if err == nil && string(pvc.UID) != entry.PVCUID && k8sutil.GetStorageClassName(pvc) == entry.DestinationStorageClass {
+		if csiPVName == "" {
+			csiPVName = pvc.Spec.VolumeName
+		}
+		if csiPVName != "" && entry.reached(stepPlaceholderRemoved) {
+			logger.DefaultLog("Update Reclaim policy from Delete to Reclaim for CSI PV: %s", csiPVName)
+			csiPV, err := k8sutil.GetPV(client, csiPVName)
+			if err != nil {
+				return fmt.Errorf("failed to get CSI PV object with name %s: %v", csiPVName, err)
+			}
+			if err = j.backupPV(entry, csiPV); err != nil {
+				return err
+			}
+			err = k8sutil.UpdateReclaimPolicy(client, csiPV)
+			if err != nil {
+				return fmt.Errorf("failed to update ReclaimPolicy for CSI PV object %s: %v", csiPVName, err)
+			}
+		}
+
+		if err = j.backupPVC(entry, pvc); err != nil {
+			return err
+		}
+		logger.DefaultLog("Deleting CSI pvc object: %s", pvc.Name)
+		err = k8sutil.DeletePVC(client, pvc)
+		if err != nil {
+			return fmt.Errorf("failed to Delete CSI PVC object %s: %v", pvc.Name, err)
+		}
+	}
+
+	if entry.isStatic() {
+		return removeStaticPV(client, entry)
+	}
+	if csiPVName == "" {
+		return nil
+	}
+	csiPV, err := k8sutil.GetPV(client, csiPVName)
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get CSI PV object with name %s: %v", csiPVName, err)
+	}
+	if !entry.reached(stepPlaceholderRemoved) {
+		// the CSI provisioner deletes the PV along with the placeholder image.
+		logger.DefaultLog("Waiting for CSI PV %s and its placeholder volume to be deleted", csiPVName)
+		err = k8sutil.WaitForPVDeletion(client, csiPV, csiPVDeleteTimeout)
+	} else {
+		logger.DefaultLog("Delete CSI PV object: %s", csiPVName)
+		err = k8sutil.DeletePV(client, csiPV)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete CSI persistent volume %s: %v", csiPVName, err)
+	}
+	return nil
+}
+
+// removeStaticPV deletes the static CSI PV which replaced the original PV. The
+// static PV is always retained so the image is left untouched.
+func removeStaticPV(client *k8s.Clientset, entry *journalEntry) error {
+	pv, err := k8sutil.GetPV(client, entry.PVName)
+	if apierrs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+	}
+	if pv.UID == entry.OriginalPV.UID {
+		// the original PV wasn't replaced yet.
+		return nil
+	}
+	logger.DefaultLog("Delete static CSI PV object: %s", pv.Name)
+	err = k8sutil.DeletePV(client, pv)
+	if err != nil {
+		return fmt.Errorf("failed to delete static CSI persistent volume %s: %v", pv.Name, err)
+	}
+	return nil
+}
+
+// restorePV recreates the original PV if it was deleted, and makes it
+// available to be bound again by the original PVC.
+func restorePV(client *k8s.Clientset, entry *journalEntry) (*v1.PersistentVolume, error) {
+	pv, err := k8sutil.GetPV(client, entry.PVName)
+	if apierrs.IsNotFound(err) {
+		logger.DefaultLog("Recreate original PV object: %s", entry.PVName)
+		pv = entry.OriginalPV.DeepCopy()
+		pv.ObjectMeta = metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+			Finalizers:  pv.Finalizers,
+		}
+		pv.Status = v1.PersistentVolumeStatus{}
+		// keep the image while the PV isn't bound to the PVC again.
+		pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+		pv.Spec.ClaimRef = unboundClaimRef(pv.Spec.ClaimRef)
+		pv, err = k8sutil.CreatePV(client, pv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to recreate PV object %s: %v", entry.PVName, err)
+		}
+		return pv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+	}
+
+	if entry.reached(stepPVCDeleted) && pv.Spec.ClaimRef != nil && string(pv.Spec.ClaimRef.UID) == entry.PVCUID {
+		logger.DefaultLog("Release PV %s from the deleted PVC %s", pv.Name, entry.PVCName)
+		pv.Spec.ClaimRef = unboundClaimRef(pv.Spec.ClaimRef)
+		err = k8sutil.UpdatePV(client, pv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to release PV object %s: %v", pv.Name, err)
+		}
+		pv, err = k8sutil.GetPV(client, entry.PVName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get PV object with name %s: %v", entry.PVName, err)
+		}
+	}
+	return pv, nil
+}
+
+// restorePVC recreates the original PVC, bound to the original PV.
+func restorePVC(client *k8s.Clientset, entry *journalEntry) error {
+	pvc, err := k8sutil.GetPVC(client, entry.PVCName, entry.PVCNamespace)
+	if err == nil {
+		logger.DefaultLog("PVC %s was already recreated, waiting for it to be bound", entry.PVCName)
+		_, err = k8sutil.WaitForBoundPV(client, pvc, pvcCreateTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to wait for PVC object %s: %v", entry.PVCName, err)
+		}
+		return nil
+	}
+	if !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to get PVC object %s: %v", entry.PVCName, err)
+	}
+
+	logger.DefaultLog("Recreate original PVC object: %s", entry.PVCName)
+	pvc = entry.OriginalPVC.DeepCopy()
+	pvc.ObjectMeta = metav1.ObjectMeta{
+		Name:            pvc.Name,
+		Namespace:       pvc.Namespace,
+		Labels:          pvc.Labels,
+		Annotations:     pvc.Annotations,
+		Finalizers:      pvc.Finalizers,
+		OwnerReferences: pvc.OwnerReferences,
+	}
+	delete(pvc.Annotations, annBindCompleted)
+	delete(pvc.Annotations, annBoundByController)
+	delete(pvc.Annotations, annStorageProvisioner)
+	if entry.Snapshot != "" {
+		// the snapshot of the old image is kept until it is cleaned up.
+		if pvc.Annotations == nil {
+			pvc.Annotations = map[string]string{}
+		}
+		pvc.Annotations[annPreMigrationSnapshot] = entry.Snapshot
+	}
+	pvc.Status = v1.PersistentVolumeClaimStatus{}
+	_, err = k8sutil.CreatePVC(client, pvc, pvcCreateTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to recreate PVC object %s: %v", entry.PVCName, err)
+	}
+	return nil
+}
+
+// unboundClaimRef returns a claim reference which only holds the name and the
+// namespace of the claim, so that a new PVC with the same name binds to the PV.
+func unboundClaimRef(claimRef *v1.ObjectReference) *v1.ObjectReference {
+	if claimRef == nil {
+		return nil
+	}
+	return &v1.ObjectReference{
+		Kind:       claimRef.Kind,
+		APIVersion: claimRef.APIVersion,
+		Name:       claimRef.Name,
+		Namespace:  claimRef.Namespace,
+	}
+}
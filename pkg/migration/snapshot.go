@@ -0,0 +1,202 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"persistent-volume-migrator/pkg/backup"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// preMigrationSnapshotPrefix is the prefix of the snapshots taken of the
+	// images before they are migrated.
+	preMigrationSnapshotPrefix = "pvm-pre-migration-"
+	// annPreMigrationSnapshot is the annotation of the migrated PVCs which
+	// holds the name of the snapshot taken of their image before the
+	// migration.
+	annPreMigrationSnapshot = "persistent-volume-migrator/pre-migration-snapshot"
+)
+
+// createPreMigrationSnapshot snapshots the old image before anything is
+// changed, so that its data can be restored if the migration goes wrong.
+func createPreMigrationSnapshot(client *k8s.Clientset, j *journal, entry *journalEntry, opts *Options) error {
+	if entry.Snapshot == "" {
+		entry.Snapshot = preMigrationSnapshotPrefix + time.Now().UTC().Format("20060102-150405")
+		if err := j.checkpoint(entry, entry.Step); err != nil {
+			return err
+		}
+	}
+	clusterID, pool, err := sourceLocation(client, entry, opts)
+	if err != nil {
+		return err
+	}
+	conn, err := createClusterConnection(client, pool, clusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+
+	// nothing was changed since a snapshot of an interrupted attempt was
+	// taken, so it is replaced.
+	if err = removeSnapshot(conn, pool, entry.SourceImage, entry.Snapshot); err != nil {
+		return err
+	}
+	logger.DefaultLog("Create snapshot %s of rbd image %s/%s", entry.Snapshot, pool, entry.SourceImage)
+	err = conn.CreateSnapshot(pool, entry.SourceImage, entry.Snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot %s of rbd image %s: %v", entry.Snapshot, entry.SourceImage, err)
+	}
+	return j.checkpoint(entry, stepSnapshotCreated)
+}
+
+// removeSourceSnapshot removes the pre-migration snapshot from the old image.
+func removeSourceSnapshot(client *k8s.Clientset, entry *journalEntry, opts *Options) error {
+	clusterID, pool, err := sourceLocation(client, entry, opts)
+	if err != nil {
+		return err
+	}
+	conn, err := createClusterConnection(client, pool, clusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	logger.DefaultLog("Remove snapshot %s of rbd image %s/%s", entry.Snapshot, pool, entry.SourceImage)
+	return removeSnapshot(conn, pool, entry.SourceImage, entry.Snapshot)
+}
+
+// sourceLocation returns the clusterID and the pool of the old image of the
+// entry.
+func sourceLocation(client *k8s.Clientset, entry *journalEntry, opts *Options) (string, string, error) {
+	dest, err := resolveDestination(client, entry.DestinationStorageClass, opts)
+	if err != nil {
+		return "", "", err
+	}
+	pool := entry.SourcePool
+	if pool == "" {
+		pool = k8sutil.GetVolumePool(entry.OriginalPV)
+	}
+	if pool == "" {
+		pool = dest.Pool
+	}
+	return dest.ClusterID, pool, nil
+}
+
+// CleanupSnapshots removes the snapshots taken of the images before their
+// migration, once the migrated applications were validated. The PVC given by
+// PVCName and PVCNamespace, or the PVCs of the destination and source
+// storageclasses selected by the filter, are cleaned up.
+func CleanupSnapshots(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return err
+	}
+
+	var pvcs []v1.PersistentVolumeClaim
+	if opts.PVCName != "" && opts.PVCNamespace != "" {
+		pvc, err := k8sutil.GetPVC(client, opts.PVCName, opts.PVCNamespace)
+		if err != nil {
+			return fmt.Errorf("failed to get PVC object %s: %v", opts.PVCName, err)
+		}
+		pvcs = append(pvcs, *pvc)
+	} else {
+		if err = opts.Filter.Validate(); err != nil {
+			return err
+		}
+		// rolled back PVCs are back in the source storageclass.
+		for _, sc := range []string{opts.DestinationStorageClass, opts.SourceStorageClass} {
+			if sc == "" {
+				continue
+			}
+			list, err := k8sutil.ListAllPVCWithStorageclass(client, sc, &opts.Filter)
+			if err != nil {
+				return fmt.Errorf("failed to list PVCs from the storageclass %s: %v", sc, err)
+			}
+			pvcs = append(pvcs, *list...)
+		}
+	}
+
+	backups := newJournal(client, opts).backups
+	removed := 0
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		snap := pvc.Annotations[annPreMigrationSnapshot]
+		if snap == "" {
+			continue
+		}
+		if err = removePreMigrationSnapshot(client, backups, pvc, snap, dest, opts); err != nil {
+			return err
+		}
+		removed++
+	}
+	logger.DefaultLog("Successfully removed %d pre-migration snapshots", removed)
+	return nil
+}
+
+// removePreMigrationSnapshot removes the snapshot from the image of the PVC
+// and the annotation recording it.
+func removePreMigrationSnapshot(client *k8s.Clientset, backups *backup.Store, pvc *v1.PersistentVolumeClaim, snap string,
+	dest *destination, opts *Options) error {
+	pv, err := k8sutil.GetPV(client, pvc.Spec.VolumeName)
+	if err != nil {
+		return fmt.Errorf("failed to get PV object with name %s: %v", pvc.Spec.VolumeName, err)
+	}
+	var clusterID, pool, imageName string
+	if pv.Spec.CSI != nil {
+		clusterID, pool, imageName = k8sutil.GetClusterID(pv), k8sutil.GetCSIPoolName(pv), k8sutil.GetCSIImageName(pv)
+	} else {
+		clusterID, pool, imageName = dest.ClusterID, k8sutil.GetVolumePool(pv), k8sutil.GetVolumeName(pv)
+		if pool == "" {
+			pool = dest.Pool
+		}
+	}
+	if imageName == "" {
+		return fmt.Errorf("rbd image name cannot be found in PV object %s", pv.Name)
+	}
+
+	conn, err := createClusterConnection(client, pool, clusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	logger.DefaultLog("Remove snapshot %s of rbd image %s/%s of PVC %s/%s", snap, pool, imageName, pvc.Namespace, pvc.Name)
+	if err = removeSnapshot(conn, pool, imageName, snap); err != nil {
+		return err
+	}
+
+	err = backups.SavePVC(backup.Group{UID: string(pvc.UID), Namespace: pvc.Namespace, Name: pvc.Name}, pvc)
+	if err != nil {
+		return fmt.Errorf("failed to backup PVC %s: %v", pvc.Name, err)
+	}
+	delete(pvc.Annotations, annPreMigrationSnapshot)
+	err = k8sutil.UpdatePVC(client, pvc)
+	if err != nil {
+		return fmt.Errorf("failed to update PVC object %s: %v", pvc.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"persistent-volume-migrator/pkg/ceph/rbd"
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// trashPrefix is the prefix the placeholder images are renamed with
+	// before they are moved to the trash, which tags them as trashed by the
+	// migration.
+	trashPrefix = "pvm-trash-"
+)
+
+// trashPlaceholder moves the placeholder image provisioned by the CSI driver
+// to the trash instead of removing it, so that it can be restored if a wrong
+// image was resolved. The image is renamed with trashPrefix first so that
+// PurgeTrash only purges the images trashed by the migration. The new name is
+// recorded in the journal before the rename, so that the image is found
+// under either name if the migration is interrupted.
+func trashPlaceholder(j *journal, conn *rbd.Connection, entry *journalEntry, delay time.Duration) error {
+	if entry.TrashImage == "" {
+		entry.TrashImage = trashPrefix + entry.CSIImage
+		if err := j.checkpoint(entry, entry.Step); err != nil {
+			return err
+		}
+	}
+	exists, err := conn.ImageExists(entry.CSIImage)
+	if err != nil {
+		return fmt.Errorf("failed to check the CSI volume in ceph cluster: %v", err)
+	}
+	if exists {
+		err = conn.RenameVolume(entry.TrashImage, entry.CSIImage)
+		if err != nil {
+			return fmt.Errorf("failed to rename the CSI volume %s to %s: %v", entry.CSIImage, entry.TrashImage, err)
+		}
+	}
+
+	if err = moveRenamedPlaceholder(conn, entry, delay); err != nil {
+		return err
+	}
+	logger.DefaultLog("Successfully moved volume %s to the trash of pool %s as %s, it can be purged after %v",
+		entry.CSIImage, entry.Pool, entry.TrashImage, delay)
+	return nil
+}
+
+// moveRenamedPlaceholder moves the placeholder image to the trash if it was
+// renamed but not moved yet.
+func moveRenamedPlaceholder(conn *rbd.Connection, entry *journalEntry, delay time.Duration) error {
+	if entry.TrashImage == "" {
+		return nil
+	}
+	exists, err := conn.ImageExists(entry.TrashImage)
+	if err != nil {
+		return fmt.Errorf("failed to check the CSI volume in ceph cluster: %v", err)
+	}
+	if !exists {
+		return nil
+	}
+	err = conn.MoveToTrash(entry.Pool, entry.TrashImage, delay)
+	if err != nil && !errors.Is(err, rbd.ErrImageNotFound) {
+		return fmt.Errorf("failed to move the CSI volume %s to the trash: %v", entry.TrashImage, err)
+	}
+	return nil
+}
+
+// trashInterruptedPlaceholders moves to the trash the placeholder images of
+// the pool whose move to the trash was interrupted after their rename, which
+// are recorded in the journal.
+func trashInterruptedPlaceholders(client *k8s.Clientset, conn *rbd.Connection, pool string, opts *Options) error {
+	entries, err := newJournal(client, opts).list()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Pool != pool || entry.TrashImage == "" || entry.reached(stepPlaceholderRemoved) {
+			continue
+		}
+		// the placeholder wasn't renamed yet.
+		exists, err := conn.ImageExists(entry.CSIImage)
+		if err != nil {
+			return fmt.Errorf("failed to check the CSI volume in ceph cluster: %v", err)
+		}
+		if exists {
+			continue
+		}
+		logger.DefaultLog("Move the placeholder image %s of PVC %s/%s to the trash", entry.TrashImage, entry.PVCNamespace, entry.PVCName)
+		if err = moveRenamedPlaceholder(conn, entry, opts.TrashDelay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeTrash removes from the trash of the pool of the destination
+// storageclass the placeholder images trashed by the migration whose
+// deferment period has expired. The other images of the trash are left
+// untouched. The placeholder images whose move to the trash was interrupted
+// are moved to the trash first.
+func PurgeTrash(opts *Options) error {
+	logger.DefaultLog("Create Kubernetes Client")
+	client, err := k8sutil.NewClient(opts.KubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+	dest, err := resolveDestination(client, opts.DestinationStorageClass, opts)
+	if err != nil {
+		return err
+	}
+	if dest.Pool == "" {
+		return fmt.Errorf("pool parameter is missing in destination StorageClass %s", opts.DestinationStorageClass)
+	}
+
+	conn, err := createClusterConnection(client, dest.Pool, dest.ClusterID, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster config %v", err)
+	}
+	defer closeConnection(conn)
+	if err = trashInterruptedPlaceholders(client, conn, dest.Pool, opts); err != nil {
+		return err
+	}
+	trash, err := conn.ListTrash(dest.Pool)
+	if err != nil {
+		return fmt.Errorf("failed to list the trash of pool %s: %v", dest.Pool, err)
+	}
+
+	purged, pending := 0, 0
+	for _, image := range trash {
+		if !strings.HasPrefix(image.Name, trashPrefix) {
+			continue
+		}
+		err = conn.RemoveFromTrash(dest.Pool, image.ID)
+		if errors.Is(err, rbd.ErrTrashNotExpired) {
+			logger.DefaultLog("deferment period of rbd image %s has not expired, keeping it", image.Name)
+			pending++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to purge rbd image %s from the trash: %v", image.Name, err)
+		}
+		logger.DefaultLog("purged rbd image %s from the trash of pool %s", image.Name, dest.Pool)
+		purged++
+	}
+	logger.DefaultLog("Successfully purged %d rbd images from the trash, %d not expired yet", purged, pending)
+	return nil
+}
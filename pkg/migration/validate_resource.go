@@ -20,17 +20,24 @@ import (
 	"context"
 	"fmt"
 
+	"persistent-volume-migrator/pkg/k8sutil"
+
+	storagev1 "k8s.io/api/storage/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
-// validateResources checks if required areguments exists
-func validateResources(client *k8s.Clientset, sourceSC, destinationSC, rookNS, cephClusterNS string) error {
+// validateResources checks if required areguments exists, and that the
+// destination storageclass stores its images in the pool of the source
+// storageclass, unless the images are moved, copied to another cluster or
+// used where they are by a static PV.
+func validateResources(client *k8s.Clientset, opts *Options) error {
 	getOpt := v1.GetOptions{}
 	ctx := context.TODO()
+	sourceSC, destinationSC, rookNS, cephClusterNS := opts.SourceStorageClass, opts.DestinationStorageClass, opts.RookNamespace, opts.CephClusterNamespace
 
-	_, err := client.StorageV1().StorageClasses().Get(ctx, destinationSC, getOpt)
+	destination, err := client.StorageV1().StorageClasses().Get(ctx, destinationSC, getOpt)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
 			return fmt.Errorf("destination storageClass %s doesn't exist. %w", destinationSC, err)
@@ -39,13 +46,16 @@ func validateResources(client *k8s.Clientset, sourceSC, destinationSC, rookNS, c
 	}
 
 	if sourceSC != "" {
-		_, err = client.StorageV1().StorageClasses().Get(ctx, sourceSC, getOpt)
+		source, err := client.StorageV1().StorageClasses().Get(ctx, sourceSC, getOpt)
 		if err != nil {
 			if kerrors.IsNotFound(err) {
 				return fmt.Errorf("source storageClass %s doesn't exist. %w", sourceSC, err)
 			}
 			return fmt.Errorf("failed to get Source StorageClass name %s. %w", sourceSC, err)
 		}
+		if err = validatePools(source, destination, opts); err != nil {
+			return err
+		}
 	}
 
 	if rookNS != "" {
@@ -70,3 +80,22 @@ func validateResources(client *k8s.Clientset, sourceSC, destinationSC, rookNS, c
 
 	return nil
 }
+
+// validatePools returns an error if the source and destination rbd
+// storageclasses use different pools and the images aren't moved to the pool
+// of the destination storageclass. The PVs of a single PVC are checked by
+// checkSourcePool instead.
+func validatePools(source, destination *storagev1.StorageClass, opts *Options) error {
+	if opts.CrossPool || opts.Static || k8sutil.GetStorageClassFSName(destination) != "" {
+		return nil
+	}
+	if opts.SourceClusterID != "" && opts.SourceClusterID != k8sutil.GetStorageClassClusterID(destination) {
+		return nil
+	}
+	sourcePool, destinationPool := k8sutil.GetStorageClassPoolName(source), k8sutil.GetStorageClassPoolName(destination)
+	if sourcePool == "" || destinationPool == "" || sourcePool == destinationPool {
+		return nil
+	}
+	return fmt.Errorf("source StorageClass %s uses pool %s but destination StorageClass %s uses pool %s, use --cross-pool to move the images",
+		source.Name, sourcePool, destination.Name, destinationPool)
+}
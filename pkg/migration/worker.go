@@ -0,0 +1,235 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	logger "persistent-volume-migrator/pkg/log"
+	"persistent-volume-migrator/pkg/metrics"
+	"persistent-volume-migrator/pkg/report"
+)
+
+// errNotAttempted is the result of the PVCs which weren't migrated because
+// the run stopped at the failure of another PVC.
+var errNotAttempted = errors.New("not attempted after a previous failure")
+
+// pvcResult is the outcome of the migration of a single PVC.
+type pvcResult struct {
+	namespace string
+	name      string
+	uid       string
+	// entry is the journal entry of the migration, nil if the migration
+	// failed before it was created.
+	entry    *journalEntry
+	duration time.Duration
+	err      error
+}
+
+const (
+	// PVCPending is the phase of a PVC whose migration didn't start yet.
+	PVCPending = "Pending"
+	// PVCMigrating is the phase of a PVC being migrated.
+	PVCMigrating = "Migrating"
+	// PVCMigrated is the phase of a PVC whose migration completed.
+	PVCMigrated = "Migrated"
+	// PVCFailed is the phase of a PVC whose migration failed.
+	PVCFailed = "Failed"
+)
+
+// PVCProgress is the state of the migration of a PVC, reported to
+// Options.Progress.
+type PVCProgress struct {
+	Namespace string
+	Name      string
+	UID       string
+	Phase     string
+	// Step is the last step of the migration which was completed.
+	Step string
+	// Err is the error the migration failed with.
+	Err error
+}
+
+// withProgress wraps migrate to report the progress of the migration of
+// every PVC to the metrics and to opts.Progress, if it is set. Every PVC is
+// reported pending first.
+func withProgress(opts *Options, results []pvcResult, migrate func(i int) (*journalEntry, error)) func(i int) (*journalEntry, error) {
+	report := func(p PVCProgress) {
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	metrics.PVCsDiscovered.Add(float64(len(results)))
+	for _, r := range results {
+		report(PVCProgress{Namespace: r.namespace, Name: r.name, UID: r.uid, Phase: PVCPending})
+	}
+	return func(i int) (*journalEntry, error) {
+		p := PVCProgress{Namespace: results[i].namespace, Name: results[i].name, UID: results[i].uid, Phase: PVCMigrating}
+		report(p)
+		metrics.PVCsInProgress.Inc()
+		entry, err := migrate(i)
+		metrics.PVCsInProgress.Dec()
+		p.Phase, p.Err = PVCMigrated, err
+		if err != nil {
+			p.Phase = PVCFailed
+			metrics.PVCsFailed.Inc()
+		} else {
+			metrics.PVCsMigrated.Inc()
+		}
+		if entry != nil {
+			p.Step = string(entry.Step)
+		}
+		report(p)
+		return entry, err
+	}
+}
+
+// runWorkers runs migrate for every PVC on at most parallelism workers and
+// returns the result of each PVC, in the order of the PVCs. Unless
+// continueOnError is set, no new migration is started after the first
+// failure, nor once ctx is done; the migrations already running are
+// completed.
+func runWorkers(ctx context.Context, results []pvcResult, parallelism int, continueOnError bool, migrate func(i int) (*journalEntry, error)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	for i := range results {
+		results[i].err = errNotAttempted
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+	)
+	next := make(chan int)
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				start := time.Now()
+				entry, err := migrate(i)
+				mu.Lock()
+				results[i].entry = entry
+				results[i].duration = time.Since(start)
+				results[i].err = err
+				if err != nil && !continueOnError {
+					stopped = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range results {
+		mu.Lock()
+		stop := stopped
+		mu.Unlock()
+		if stop {
+			break
+		}
+		select {
+		case next <- i:
+			continue
+		case <-ctx.Done():
+			logger.ErrorLog("migration interrupted, waiting for the running migrations to complete")
+		}
+		break
+	}
+	close(next)
+	wg.Wait()
+}
+
+// summarize logs the result of every PVC and returns an error if any of them
+// wasn't migrated.
+func summarize(action string, results []pvcResult) error {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			logger.ErrorLog("failed to %s PVC %s/%s: %v", action, r.namespace, r.name, r.err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to %s %d of %d PVCs", action, failed, len(results))
+	}
+	return nil
+}
+
+// writeReport writes the results of the run to the report file, if one was
+// requested.
+func writeReport(results []pvcResult, start time.Time, opts *Options) error {
+	if opts.ReportFile == "" {
+		return nil
+	}
+	r := &report.Report{
+		SourceStorageClass:      opts.SourceStorageClass,
+		DestinationStorageClass: opts.DestinationStorageClass,
+		StartTime:               start,
+		EndTime:                 time.Now(),
+	}
+	for _, res := range results {
+		record := report.PVCRecord{
+			Namespace:       res.namespace,
+			Name:            res.name,
+			UID:             res.uid,
+			Status:          report.StatusMigrated,
+			DurationSeconds: res.duration.Seconds(),
+		}
+		switch {
+		case errors.Is(res.err, errNotAttempted):
+			record.Status = report.StatusNotAttempted
+		case res.err != nil:
+			record.Status = report.StatusFailed
+			record.Error = res.err.Error()
+		}
+		if e := res.entry; e != nil {
+			record.OldPVName = e.PVName
+			record.OldImage = e.SourceImage
+			record.NewPVName = e.CSIPVName
+			record.NewImage = e.CSIImage
+			record.Pool = e.Pool
+			record.ClusterID = e.ClusterID
+			record.Snapshot = e.Snapshot
+			record.MetadataChanges = e.MetadataChanges
+			record.Step = string(e.Step)
+		}
+		r.PVCs = append(r.PVCs, record)
+	}
+
+	err := report.WriteFile(opts.ReportFile, opts.ReportFormat, r)
+	if err != nil {
+		return fmt.Errorf("failed to write the migration report: %v", err)
+	}
+	logger.DefaultLog("Migration report written to %s", opts.ReportFile)
+	return nil
+}
+
+// closeConnection closes a connection to the ceph cluster, which removes its
+// key material.
+func closeConnection(conn io.Closer) {
+	err := conn.Close()
+	if err != nil {
+		logger.ErrorLog("failed to destroy the connection: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"persistent-volume-migrator/pkg/k8sutil"
+	logger "persistent-volume-migrator/pkg/log"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	volumeReleaseTimeout = 10 * time.Minute
+	volumeReleasePoll    = 5 * time.Second
+)
+
+// scaleDownWorkloads scales down the workloads whose pods mount any of the
+// PVCs and waits for the volumes to be released. It returns the workloads it
+// scaled down, even on error, so that the caller can restore them.
+func scaleDownWorkloads(client *k8s.Clientset, pvcs []v1.PersistentVolumeClaim) ([]k8sutil.Workload, error) {
+	workloads, err := k8sutil.ListWorkloadsUsingPVCs(client, pvcs)
+	if err != nil {
+		return nil, err
+	}
+
+	var scaled []k8sutil.Workload
+	for _, w := range workloads {
+		logger.DefaultLog("scaling down %s", w)
+		err = k8sutil.ScaleDownWorkload(client, w)
+		if err != nil {
+			return scaled, fmt.Errorf("failed to scale down %s: %v", w, err)
+		}
+		scaled = append(scaled, w)
+	}
+
+	return scaled, waitForVolumesReleased(client, pvcs)
+}
+
+// restoreWorkloads restores the workloads scaled down by scaleDownWorkloads.
+// It carries on restoring the other workloads if one of them fails.
+func restoreWorkloads(client *k8s.Clientset, workloads []k8sutil.Workload) {
+	for _, w := range workloads {
+		logger.DefaultLog("restoring %s", w)
+		err := k8sutil.RestoreWorkload(client, w)
+		if err != nil {
+			logger.ErrorLog("failed to restore %s: %v", w, err)
+		}
+	}
+}
+
+// waitForVolumesReleased waits until no pod mounts any of the PVCs and their
+// PVs are detached from all the nodes.
+func waitForVolumesReleased(client *k8s.Clientset, pvcs []v1.PersistentVolumeClaim) error {
+	start := time.Now()
+	err := wait.PollImmediate(volumeReleasePoll, volumeReleaseTimeout, func() (bool, error) {
+		for i := range pvcs {
+			pods, err := k8sutil.ListPodsUsingPVC(client, &pvcs[i])
+			if err != nil {
+				return false, err
+			}
+			if len(pods) > 0 {
+				logger.DefaultLog("waiting for %d pods using PVC %s/%s to terminate (%d seconds elapsed)",
+					len(pods), pvcs[i].Namespace, pvcs[i].Name, int(time.Since(start).Seconds()))
+				return false, nil
+			}
+			if pvcs[i].Spec.VolumeName == "" {
+				continue
+			}
+			attachments, err := k8sutil.ListVolumeAttachments(client, pvcs[i].Spec.VolumeName)
+			if err != nil {
+				return false, err
+			}
+			if len(attachments) > 0 {
+				logger.DefaultLog("waiting for PV %s to be detached (%d seconds elapsed)",
+					pvcs[i].Spec.VolumeName, int(time.Since(start).Seconds()))
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for the volumes to be released: %v", err)
+	}
+	return nil
+}
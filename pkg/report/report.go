@@ -0,0 +1,157 @@
+/*
+Copyright © 2021 The Persistent-Volume-Migrator Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package report writes the outcome of a migration run in a machine-readable
+// format.
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatCSV  = "csv"
+
+	// StatusMigrated is the status of a PVC whose migration completed.
+	StatusMigrated = "migrated"
+	// StatusFailed is the status of a PVC whose migration failed.
+	StatusFailed = "failed"
+	// StatusNotAttempted is the status of a PVC which wasn't migrated because
+	// the run stopped at the failure of another PVC.
+	StatusNotAttempted = "not-attempted"
+)
+
+// Formats returns the supported report formats.
+func Formats() []string {
+	return []string{FormatJSON, FormatYAML, FormatCSV}
+}
+
+// CheckFormat returns an error if the report format isn't supported.
+func CheckFormat(format string) error {
+	for _, f := range Formats() {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported report format %q, supported formats: %v", format, Formats())
+}
+
+// Report is the outcome of a migration run.
+type Report struct {
+	SourceStorageClass      string      `json:"sourceStorageClass"`
+	DestinationStorageClass string      `json:"destinationStorageClass"`
+	StartTime               time.Time   `json:"startTime"`
+	EndTime                 time.Time   `json:"endTime"`
+	PVCs                    []PVCRecord `json:"pvcs"`
+}
+
+// PVCRecord is the outcome of the migration of a single PVC.
+type PVCRecord struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+	Status    string `json:"status"`
+	OldPVName string `json:"oldPVName,omitempty"`
+	OldImage  string `json:"oldImage,omitempty"`
+	NewPVName string `json:"newPVName,omitempty"`
+	NewImage  string `json:"newImage,omitempty"`
+	Pool      string `json:"pool,omitempty"`
+	ClusterID string `json:"clusterID,omitempty"`
+	// Snapshot is the snapshot taken of the old image before the migration.
+	Snapshot string `json:"snapshot,omitempty"`
+	// MetadataChanges lists the labels, annotations, finalizers and owner
+	// references of the PVC which were not carried over as they were.
+	MetadataChanges []string `json:"metadataChanges,omitempty"`
+	// Step is the last step of the migration which was completed.
+	Step            string  `json:"step,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+var csvHeader = []string{
+	"namespace", "name", "uid", "status", "oldPVName", "oldImage", "newPVName", "newImage",
+	"pool", "clusterID", "snapshot", "metadataChanges", "step", "durationSeconds", "error",
+}
+
+// WriteFile writes the report to the file in the given format.
+func WriteFile(path, format string, r *Report) error {
+	if err := CheckFormat(format); err != nil {
+		return err
+	}
+	f, err := os.Create(path) // #nosec G304 the report path is given by the user.
+	if err != nil {
+		return fmt.Errorf("failed to create report file %s: %w", path, err)
+	}
+	err = Write(f, format, r)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close report file %s: %w", path, closeErr)
+	}
+	return err
+}
+
+// Write writes the report to w in the given format.
+func Write(w io.Writer, format string, r *Report) error {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize report: %w", err)
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case FormatYAML:
+		data, err := yaml.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to serialize report: %w", err)
+		}
+		_, err = w.Write(data)
+		return err
+	case FormatCSV:
+		return writeCSV(w, r)
+	}
+	return CheckFormat(format)
+}
+
+// writeCSV writes one row per PVC. The details of the run itself are left
+// out, as they don't fit in the rows.
+func writeCSV(w io.Writer, r *Report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, p := range r.PVCs {
+		row := []string{
+			p.Namespace, p.Name, p.UID, p.Status, p.OldPVName, p.OldImage, p.NewPVName, p.NewImage,
+			p.Pool, p.ClusterID, p.Snapshot, strings.Join(p.MetadataChanges, "; "), p.Step, strconv.FormatFloat(p.DurationSeconds, 'f', 3, 64), p.Error,
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}